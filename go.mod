@@ -3,6 +3,7 @@ module github.com/vkuznet/TFaaS
 go 1.20
 
 require (
+	github.com/fsnotify/fsnotify v1.6.0
 	github.com/galeone/tensorflow/tensorflow/go v0.0.0-20221023090153-6b7fa0680c3e
 	github.com/galeone/tfgo v0.0.0-20230214145115-56cedbc50978
 	github.com/golang/protobuf v1.5.2
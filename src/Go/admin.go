@@ -0,0 +1,52 @@
+package main
+
+// admin module provides admin APIs to inspect and control models cache
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// AdminModelsHandler lists models loaded into the cache
+func AdminModelsHandler(w http.ResponseWriter, r *http.Request) {
+	responseJSON(w, _cache.records())
+}
+
+// AdminModelHandler explicitly loads, unloads or reloads given model
+func AdminModelHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	model := vars["model"]
+	action := vars["action"]
+	if _, err := tfVersion(model); err != nil {
+		responseError(w, fmt.Sprintf("unknown model %s", model), err, http.StatusNotFound)
+		return
+	}
+	var err error
+	switch action {
+	case "load", "reload":
+		// for loaded models both actions reload the model
+		err = preloadModel(model)
+	case "unload":
+		_cache.remove(model)
+	default:
+		responseError(w, fmt.Sprintf("unsupported action %s", action), nil, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		msg := fmt.Sprintf("unable to %s model %s", action, model)
+		responseError(w, msg, err, http.StatusInternalServerError)
+		return
+	}
+	log.Printf("admin %s model %s", action, model)
+	responseJSON(w, _cache.records())
+}
+
+// AdminCacheHandler flushes models cache
+func AdminCacheHandler(w http.ResponseWriter, r *http.Request) {
+	_cache.flush()
+	log.Println("admin flush cache")
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,420 @@
+package main
+
+// auth module provides x509 authentication and DN based authorization of clients
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OIDs of proxy certificate information extension of RFC 3820 and its draft
+var (
+	oidProxyCertInfo      = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 14}
+	oidProxyCertInfoDraft = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 3536, 1, 222}
+	oidCommonName         = asn1.ObjectIdentifier{2, 5, 4, 3}
+)
+
+// helper function to check if certificate is a grid proxy certificate issued
+// by given certificate, proxies have subject of their issuer with additional
+// CN and either proxy certificate information extension (RFC 3820) or
+// "proxy" or "limited proxy" CN (legacy globus proxies)
+func isProxyCert(cert, issuer *x509.Certificate) bool {
+	names, inames := cert.Subject.Names, issuer.Subject.Names
+	if len(names) != len(inames)+1 || !names[len(names)-1].Type.Equal(oidCommonName) {
+		return false
+	}
+	for i, name := range inames {
+		if !name.Type.Equal(names[i].Type) || fmt.Sprint(name.Value) != fmt.Sprint(names[i].Value) {
+			return false
+		}
+	}
+	if !bytes.Equal(cert.RawIssuer, issuer.RawSubject) {
+		return false
+	}
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(oidProxyCertInfo) || ext.Id.Equal(oidProxyCertInfoDraft) {
+			return true
+		}
+	}
+	cn := fmt.Sprint(names[len(names)-1].Value)
+	return cn == "proxy" || cn == "limited proxy"
+}
+
+// helper function to find end-entity certificate in client certificates,
+// i.e. first certificate which is not a proxy, it returns its index
+func endEntityCert(certs []*x509.Certificate) int {
+	idx := 0
+	for idx+1 < len(certs) && isProxyCert(certs[idx], certs[idx+1]) {
+		idx++
+	}
+	return idx
+}
+
+// helper function to verify client certificates against given CAs, proxy
+// certificates are verified against their issuers while end-entity
+// certificate is verified against CAs and CRLs
+func verifyClientCerts(certs []*x509.Certificate, roots *x509.CertPool) error {
+	if len(certs) == 0 {
+		return errors.New("client certificate is not provided")
+	}
+	if roots == nil {
+		// we never fall back to system CAs to verify clients
+		return errors.New("client CAs are not configured")
+	}
+	now := time.Now()
+	idx := endEntityCert(certs)
+	for i := 0; i < idx; i++ {
+		proxy, issuer := certs[i], certs[i+1]
+		// proxies are signed by end-entity certificates which are not CAs,
+		// therefore we check proxy signature directly
+		if err := issuer.CheckSignature(proxy.SignatureAlgorithm, proxy.RawTBSCertificate, proxy.Signature); err != nil {
+			return fmt.Errorf("invalid signature of proxy certificate %s: %v", certDN(proxy), err)
+		}
+		if now.Before(proxy.NotBefore) || now.After(proxy.NotAfter) {
+			return fmt.Errorf("proxy certificate %s is expired or not yet valid", certDN(proxy))
+		}
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[idx+1:] {
+		intermediates.AddCert(cert)
+	}
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	chains, err := certs[idx].Verify(opts)
+	if err != nil {
+		return err
+	}
+	return _serverCerts.checkRevoked(chains[0])
+}
+
+// helper function to verify client certificates during TLS handshake, it is
+// used as tls.Config.VerifyPeerCertificate since standard verification does
+// not accept grid proxies
+func verifyPeerCertificate(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return nil
+	}
+	var certs []*x509.Certificate
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+	roots := _serverCerts.clientCAs()
+	if roots == nil {
+		// client CAs are not configured (yet), certificates are not verified
+		return nil
+	}
+	if err := verifyClientCerts(certs, roots); err != nil {
+		log.Println("unable to verify client certificate", err)
+		return err
+	}
+	return nil
+}
+
+// helper function to format subject of client certificate as DN,
+// e.g. /DC=ch/DC=cern/OU=Organic Units/OU=Users/CN=user/CN=123/CN=User Name
+func certDN(cert *x509.Certificate) string {
+	var dn string
+	for _, name := range cert.Subject.Names {
+		var key string
+		switch {
+		case name.Type.Equal([]int{0, 9, 2342, 19200300, 100, 1, 25}):
+			key = "DC"
+		case name.Type.Equal([]int{2, 5, 4, 3}):
+			key = "CN"
+		case name.Type.Equal([]int{2, 5, 4, 6}):
+			key = "C"
+		case name.Type.Equal([]int{2, 5, 4, 7}):
+			key = "L"
+		case name.Type.Equal([]int{2, 5, 4, 8}):
+			key = "ST"
+		case name.Type.Equal([]int{2, 5, 4, 10}):
+			key = "O"
+		case name.Type.Equal([]int{2, 5, 4, 11}):
+			key = "OU"
+		case name.Type.Equal([]int{0, 9, 2342, 19200300, 100, 1, 1}):
+			key = "UID"
+		case name.Type.Equal([]int{1, 2, 840, 113549, 1, 9, 1}):
+			key = "emailAddress"
+		default:
+			key = name.Type.String()
+		}
+		dn = fmt.Sprintf("%s/%s=%v", dn, key, name.Value)
+	}
+	return dn
+}
+
+// helper function to check if request comes from loopback interface
+func localRequest(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback() && r.Header.Get("X-Forwarded-For") == ""
+}
+
+// UserDN function provides user Distinguished Name (DN) of verified client
+// certificate of HTTP request, DN of grid proxy is DN of its end-entity certificate
+func UserDN(r *http.Request) (string, error) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return "", errors.New("client certificate is not provided")
+	}
+	if len(r.TLS.VerifiedChains) > 0 {
+		return certDN(r.TLS.VerifiedChains[0][0]), nil
+	}
+	// client CAs and CRLs may be reloaded after TLS handshake, therefore we
+	// verify certificates against current ones
+	roots := _serverCerts.clientCAs()
+	if roots == nil {
+		return "", errors.New("client certificate is not verified")
+	}
+	certs := r.TLS.PeerCertificates
+	if err := verifyClientCerts(certs, roots); err != nil {
+		return "", err
+	}
+	return certDN(certs[endEntityCert(certs)]), nil
+}
+
+// DNProvider provides list of authorized user DNs
+type DNProvider interface {
+	DNs() ([]string, error)
+}
+
+// FileDNProvider provides user DNs from local file
+type FileDNProvider struct {
+	File string // file name
+}
+
+// DNs reads user DNs from the file
+func (p *FileDNProvider) DNs() ([]string, error) {
+	data, err := ioutil.ReadFile(p.File)
+	if err != nil {
+		return nil, err
+	}
+	return parseDNs(data)
+}
+
+// HTTPDNProvider provides user DNs from HTTP JSON end-point
+type HTTPDNProvider struct {
+	URL string // end-point URL
+}
+
+// DNs fetches user DNs from the end-point
+func (p *HTTPDNProvider) DNs() ([]string, error) {
+	req, err := http.NewRequest("GET", p.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Accept", "application/json")
+	resp, err := _client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s replied with %s", p.URL, resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return parseDNs(data)
+}
+
+// helper function to parse user DNs, it accepts JSON list of DNs or of
+// objects with dn attribute, otherwise DNs are read line by line skipping
+// empty lines and comments
+func parseDNs(data []byte) ([]string, error) {
+	var dns []string
+	data = bytes.TrimSpace(data)
+	if bytes.HasPrefix(data, []byte("[")) {
+		var records []json.RawMessage
+		if err := json.Unmarshal(data, &records); err != nil {
+			return nil, err
+		}
+		for _, rec := range records {
+			var dn string
+			if err := json.Unmarshal(rec, &dn); err != nil {
+				var obj struct {
+					DN string `json:"dn"`
+				}
+				if err := json.Unmarshal(rec, &obj); err != nil {
+					return nil, err
+				}
+				dn = obj.DN
+			}
+			if dn != "" {
+				dns = append(dns, dn)
+			}
+		}
+		return dns, nil
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		dns = append(dns, line)
+	}
+	return dns, nil
+}
+
+// helper function to create DN provider for given source, i.e. file name
+// or HTTP URL
+func newDNProvider(source string) DNProvider {
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		return &HTTPDNProvider{URL: source}
+	}
+	return &FileDNProvider{File: strings.TrimPrefix(source, "file://")}
+}
+
+// UserDNs keeps authorized user DNs obtained from DN provider, DNs are
+// refreshed in background once they are older than TTL
+type UserDNs struct {
+	Provider   DNProvider    // source of user DNs
+	TTL        time.Duration // time to keep DNs before refreshing them
+	DNs        map[string]bool
+	Time       time.Time // time when DNs were obtained
+	refreshing bool      // DNs are being refreshed
+	mu         sync.Mutex
+}
+
+// global variable which keeps authorized user DNs
+var _userDNs UserDNs
+
+// refresh obtains user DNs from DN provider, previous DNs are kept if
+// provider is not available
+func (u *UserDNs) refresh() {
+	dns, err := u.Provider.DNs()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err != nil {
+		log.Println("unable to get user DNs", err)
+	} else {
+		u.DNs = make(map[string]bool)
+		for _, dn := range dns {
+			u.DNs[dn] = true
+		}
+	}
+	// do not hammer unavailable provider on every request
+	u.Time = time.Now()
+	u.refreshing = false
+}
+
+// helper function to check if DN is listed in admins, roles or groups of
+// server configuration
+func configuredDN(dn string) bool {
+	if InList(dn, _config.Admins) {
+		return true
+	}
+	for _, entries := range _config.Roles {
+		if InList(dn, entries) {
+			return true
+		}
+	}
+	for _, members := range _config.Groups {
+		if InList(dn, members) {
+			return true
+		}
+	}
+	return false
+}
+
+// authorized checks if given DN is authorized, if DN provider is not
+// configured only DNs listed in server configuration are authorized when
+// authentication is required, otherwise DNs are not restricted
+func (u *UserDNs) authorized(dn string) bool {
+	if u.Provider == nil {
+		return !_config.Auth || configuredDN(dn)
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if time.Since(u.Time) > u.TTL && !u.refreshing {
+		// requests are not blocked while DNs are being refreshed
+		u.refreshing = true
+		go u.refresh()
+	}
+	return u.DNs[dn]
+}
+
+// helper function to authenticate and authorize HTTP request, it returns
+// identity of the client, API keys and bearer tokens take precedence over
+// other methods, requests from local host are trusted only if it is enabled,
+// clients without valid certificate are anonymous unless authentication
+// is required
+func auth(r *http.Request) (Identity, int, error) {
+	if token := bearerToken(r); token != "" {
+		// invalid credentials are always rejected
+		id, err := tokenIdentity(token)
+		if err != nil {
+			return Identity{Method: "anonymous"}, http.StatusUnauthorized, err
+		}
+		return id, http.StatusOK, nil
+	}
+	if _config.TrustLocalhost && localRequest(r) {
+		return Identity{Name: "localhost", Method: "local", Role: RoleAdmin}, http.StatusOK, nil
+	}
+	anonymous := Identity{Method: "anonymous", Role: _config.DefaultRole}
+	dn, err := UserDN(r)
+	if err != nil {
+		if _config.Auth {
+			return anonymous, http.StatusUnauthorized, err
+		}
+		return anonymous, http.StatusOK, nil
+	}
+	id := Identity{Name: dn, Method: "x509"}
+	if !InList(dn, _config.Admins) && !_userDNs.authorized(dn) {
+		if _config.Auth {
+			return id, http.StatusForbidden, fmt.Errorf("user %s is not authorized", dn)
+		}
+		return anonymous, http.StatusOK, nil
+	}
+	id.assignRole()
+	return id, http.StatusOK, nil
+}
+
+// helper function to initialize x509 authentication and server certificates
+// from server configuration
+func initAuth() error {
+	if err := _serverCerts.load(); err != nil {
+		return err
+	}
+	switch _config.ClientAuth {
+	case ClientAuthRequest, ClientAuthVerify, ClientAuthRequire:
+	default:
+		return fmt.Errorf("unknown client auth mode %s", _config.ClientAuth)
+	}
+	for role := range _config.Roles {
+		if roleLevel(role) < 0 {
+			return fmt.Errorf("unknown role %s, supported roles: %v", role, _roles)
+		}
+	}
+	if _config.DefaultRole != "none" && roleLevel(_config.DefaultRole) < 0 {
+		return fmt.Errorf("unknown default role %s, supported roles: %v", _config.DefaultRole, _roles)
+	}
+	ttl := time.Duration(_config.AuthTTL) * time.Second
+	_userDNs = UserDNs{TTL: ttl}
+	if _config.AuthDNs != "" {
+		_userDNs.Provider = newDNProvider(_config.AuthDNs)
+		_userDNs.refresh()
+	}
+	return nil
+}
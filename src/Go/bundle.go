@@ -0,0 +1,385 @@
+package main
+
+// bundle module provides secure ingestion of uploaded model bundles
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StagingArea defines name of staging area within model directory, it is
+// hidden such that it is not listed as a model
+const StagingArea = ".staging"
+
+// ErrBundleTooLarge is returned when bundle exceeds its size limit
+var ErrBundleTooLarge = errors.New("bundle exceeds its size limit")
+
+// lock to serialize activation of uploaded models
+var _activateLock sync.Mutex
+
+// files of model area which are written by the server, bundles can't provide them
+var serverFiles = []string{EvaluationFile, MetadataFile}
+
+// model names should be valid for our HTTP routes
+var modelNameRegexp = regexp.MustCompile("^[a-zA-Z0-9_]+$")
+
+// helper function to check model name
+func validModelName(name string) bool {
+	return modelNameRegexp.MatchString(name)
+}
+
+// helper function to check that file name does not refer to other areas
+func validFileName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\")
+}
+
+// helper function to copy data from given reader into the file
+func copyFile(fname string, r io.Reader) error {
+	file, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, r)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// helper function to generate random identifier
+func randomID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		log.Println("unable to generate random id", err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// helper function to get bundle size limit in bytes
+func maxBundleSize() int64 {
+	return _config.MaxBundleSize * 1024 * 1024
+}
+
+// limitedReader returns ErrBundleTooLarge when more than N bytes are read,
+// unlike io.LimitReader which silently truncates the stream
+type limitedReader struct {
+	R io.Reader
+	N int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.R.Read(p)
+	l.N -= int64(n)
+	if l.N < 0 {
+		return n, ErrBundleTooLarge
+	}
+	return n, err
+}
+
+// Bundle represents uploaded bundle unpacked into its staging area
+type Bundle struct {
+	ID     string   // upload identifier
+	Dir    string   // staging area of the bundle
+	Root   string   // area where bundle models are unpacked
+	Models []string // names of models in the bundle
+	Size   int64    // total size of unpacked files
+}
+
+// helper function to create new bundle with its own staging area
+func newBundle() (*Bundle, error) {
+	id := randomID()
+	dir := filepath.Join(_config.ModelDir, StagingArea, id)
+	root := filepath.Join(dir, "models")
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, err
+	}
+	return &Bundle{ID: id, Dir: dir, Root: root}, nil
+}
+
+// Cleanup removes bundle staging area
+func (b *Bundle) Cleanup() {
+	if err := os.RemoveAll(b.Dir); err != nil {
+		log.Println("unable to remove staging area", b.Dir, err)
+	}
+}
+
+// Unpack streams tar, tar.gz or zip archive into bundle staging area
+func (b *Bundle) Unpack(r io.Reader) error {
+	br := bufio.NewReader(&limitedReader{R: r, N: maxBundleSize()})
+	magic, _ := br.Peek(4)
+	if bytes.HasPrefix(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		return b.untar(gz)
+	}
+	if bytes.HasPrefix(magic, []byte("PK\x03\x04")) {
+		return b.unzip(br)
+	}
+	return b.untar(br)
+}
+
+// helper function to resolve path of archive entry within staging area,
+// it rejects absolute paths, path traversal and files outside of model areas
+// and skips files written by the server
+func (b *Bundle) entryPath(name string, dir bool) (string, error) {
+	name = strings.TrimPrefix(filepath.ToSlash(name), "./")
+	name = strings.TrimSuffix(name, "/")
+	if name == "" || name == "." {
+		return "", nil
+	}
+	if !filepath.IsLocal(name) {
+		return "", fmt.Errorf("bundle entry %s points outside of model area", name)
+	}
+	parts := strings.Split(filepath.ToSlash(filepath.Clean(name)), "/")
+	model := parts[0]
+	if !validModelName(model) {
+		return "", fmt.Errorf("bundle entry %s has invalid model name %s", name, model)
+	}
+	if len(parts) == 1 && !dir {
+		return "", fmt.Errorf("bundle file %s should be placed in model directory", name)
+	}
+	if len(parts) == 2 && !dir && InList(parts[1], serverFiles) {
+		// e.g. exported models provide files written by the server
+		log.Println("skip bundle file", name)
+		return "", nil
+	}
+	if !InList(model, b.Models) {
+		b.Models = append(b.Models, model)
+	}
+	return filepath.Join(b.Root, name), nil
+}
+
+// helper function to write bundle file within staging area
+func (b *Bundle) writeFile(path string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	// we copy at most one byte more than allowed to detect oversize bundles
+	remaining := maxBundleSize() - b.Size
+	n, err := io.CopyN(file, r, remaining+1)
+	b.Size += n
+	if cerr := file.Close(); err == nil || err == io.EOF {
+		err = cerr
+	}
+	if b.Size > maxBundleSize() {
+		return ErrBundleTooLarge
+	}
+	return err
+}
+
+// helper function to unpack tar archive
+func (b *Bundle) untar(r io.Reader) error {
+	tarReader := tar.NewReader(r)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			path, err := b.entryPath(header.Name, true)
+			if err != nil {
+				return err
+			}
+			if path != "" {
+				if err := os.MkdirAll(path, 0755); err != nil {
+					return err
+				}
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			path, err := b.entryPath(header.Name, false)
+			if err != nil {
+				return err
+			}
+			if path == "" {
+				continue
+			}
+			if err := b.writeFile(path, tarReader); err != nil {
+				return err
+			}
+		default:
+			// symlinks, hard links, devices and fifos are not allowed
+			return fmt.Errorf("bundle entry %s has unsupported type %q", header.Name, header.Typeflag)
+		}
+	}
+	return nil
+}
+
+// helper function to unpack zip archive, zip format requires random access
+// therefore we first store it within staging area
+func (b *Bundle) unzip(r io.Reader) error {
+	fname := filepath.Join(b.Dir, "bundle.zip")
+	file, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, r)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	defer os.Remove(fname)
+	if err != nil {
+		return err
+	}
+	zipReader, err := zip.OpenReader(fname)
+	if err != nil {
+		return err
+	}
+	defer zipReader.Close()
+	for _, f := range zipReader.File {
+		mode := f.Mode()
+		if mode.IsDir() {
+			path, err := b.entryPath(f.Name, true)
+			if err != nil {
+				return err
+			}
+			if path != "" {
+				if err := os.MkdirAll(path, 0755); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if !mode.IsRegular() {
+			return fmt.Errorf("bundle entry %s has unsupported mode %v", f.Name, mode)
+		}
+		path, err := b.entryPath(f.Name, false)
+		if err != nil {
+			return err
+		}
+		if path == "" {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		err = b.writeFile(path, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// helper function to replace model area with given staged area, previous
+// version of the model (if any) is moved to given backup area, it returns
+// false if the model did not exist
+func replaceModelArea(staged, target, backup string) (bool, error) {
+	if _, err := os.Stat(target); err != nil {
+		if !os.IsNotExist(err) {
+			return false, err
+		}
+		return false, os.Rename(staged, target)
+	}
+	// exchange areas atomically such that model is never missing
+	if err := exchangePaths(staged, target); err == nil {
+		return true, os.Rename(staged, backup)
+	}
+	if err := os.Rename(target, backup); err != nil {
+		return true, err
+	}
+	if err := os.Rename(staged, target); err != nil {
+		// restore previous version of the model
+		if rerr := os.Rename(backup, target); rerr != nil {
+			log.Println("unable to restore previous version of", filepath.Base(target), rerr)
+		}
+		return true, err
+	}
+	return true, nil
+}
+
+// helper function to roll back activated models of the bundle, previous
+// versions of the models are restored and reloaded while new models are removed
+func (b *Bundle) rollback(names []string, existed map[string]bool) {
+	for i := len(names) - 1; i >= 0; i-- {
+		name := names[i]
+		target := filepath.Join(_config.ModelDir, name)
+		failed := filepath.Join(b.Dir, "failed-"+name)
+		if !existed[name] {
+			if err := os.Rename(target, failed); err != nil {
+				log.Println("unable to remove model", name, err)
+			}
+			_cache.remove(name)
+			delete(_activated, name)
+			log.Println("roll back new model", name)
+			continue
+		}
+		if _, err := replaceModelArea(filepath.Join(b.Dir, "previous-"+name), target, failed); err != nil {
+			log.Println("unable to restore previous version of", name, err)
+			continue
+		}
+		if err := activateModel(name); err != nil {
+			log.Println("unable to reload previous version of", name, err)
+		}
+		markActivated(name)
+		log.Println("roll back model", name)
+	}
+}
+
+// Activate moves bundle models into model directory and (re)loads them, model
+// areas are replaced atomically (where supported) and if any model fails to
+// activate all bundle models are rolled back to their previous versions
+func (b *Bundle) Activate() error {
+	_activateLock.Lock()
+	defer _activateLock.Unlock()
+	defer refreshModels()
+	uploaded := time.Now().Format(time.RFC3339)
+	var activated []string
+	existed := make(map[string]bool)
+	for _, name := range b.Models {
+		// keep metadata of the model set during its validation
+		meta, _ := readMetadata(filepath.Join(b.Root, name))
+		meta.Uploaded = uploaded
+		if err := writeMetadata(filepath.Join(b.Root, name), meta); err != nil {
+			b.rollback(activated, existed)
+			return err
+		}
+		target := filepath.Join(_config.ModelDir, name)
+		backup := filepath.Join(b.Dir, "previous-"+name)
+		ok, err := replaceModelArea(filepath.Join(b.Root, name), target, backup)
+		if err != nil {
+			b.rollback(activated, existed)
+			return err
+		}
+		existed[name] = ok
+		activated = append(activated, name)
+		log.Println("activate model", name)
+		if err := activateModel(name); err != nil {
+			b.rollback(activated, existed)
+			return fmt.Errorf("unable to activate model %s: %v", name, err)
+		}
+		markActivated(name)
+	}
+	for _, name := range activated {
+		if err := recordHistory(name); err != nil {
+			log.Println("unable to record history of", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestEntryPath tests resolution of bundle entries within staging area
+func TestEntryPath(t *testing.T) {
+	b := &Bundle{Root: "/staging/models"}
+	tests := []struct {
+		name string
+		dir  bool
+		path string
+		fail bool
+	}{
+		{"model/params.json", false, "/staging/models/model/params.json", false},
+		{"./model/model.pb", false, "/staging/models/model/model.pb", false},
+		{"model/", true, "/staging/models/model", false},
+		{"model/variables/data", false, "/staging/models/model/variables/data", false},
+		{"./", true, "", false},
+		{"model/" + EvaluationFile, false, "", false},
+		{"model/" + MetadataFile, false, "", false},
+		{"model/assets/" + MetadataFile, false, "/staging/models/model/assets/" + MetadataFile, false},
+		{"params.json", false, "", true},
+		{"../model/params.json", false, "", true},
+		{"model/../../params.json", false, "", true},
+		{"model/../other/params.json", false, "/staging/models/other/params.json", false},
+		{"/etc/passwd", false, "", true},
+		{"/model/params.json", false, "", true},
+		{"mo-del/params.json", false, "", true},
+		{"..", true, "", true},
+	}
+	for _, tt := range tests {
+		path, err := b.entryPath(tt.name, tt.dir)
+		if tt.fail {
+			if err == nil {
+				t.Errorf("%s: entry is accepted as %s", tt.name, path)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		} else if path != tt.path {
+			t.Errorf("%s: path %s, expect %s", tt.name, path, tt.path)
+		}
+	}
+}
+
+// helper function to make tar archive with single entry besides model params
+func testTar(t *testing.T, header *tar.Header, data string) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	params := `{"name": "model"}`
+	entries := []struct {
+		header *tar.Header
+		data   string
+	}{
+		{&tar.Header{Name: "model/params.json", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(params))}, params},
+		{header, data},
+	}
+	for _, e := range entries {
+		if err := tw.WriteHeader(e.header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// TestUntar tests unpacking of tar bundles
+func TestUntar(t *testing.T) {
+	_config.ModelDir = t.TempDir()
+	_config.MaxBundleSize = 1
+	tests := []struct {
+		name   string
+		header *tar.Header
+		fail   bool
+	}{
+		{"file", &tar.Header{Name: "model/labels.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 1}, false},
+		{"server file", &tar.Header{Name: "model/" + EvaluationFile, Typeflag: tar.TypeReg, Mode: 0644, Size: 1}, false},
+		{"traversal", &tar.Header{Name: "../labels.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 1}, true},
+		{"nested traversal", &tar.Header{Name: "model/../../labels.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 1}, true},
+		{"absolute path", &tar.Header{Name: "/tmp/labels.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 1}, true},
+		{"symlink", &tar.Header{Name: "model/labels.txt", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"}, true},
+		{"relative symlink", &tar.Header{Name: "model/data", Typeflag: tar.TypeSymlink, Linkname: "../../.."}, true},
+		{"hard link", &tar.Header{Name: "model/labels.txt", Typeflag: tar.TypeLink, Linkname: "/etc/passwd"}, true},
+		{"fifo", &tar.Header{Name: "model/fifo", Typeflag: tar.TypeFifo}, true},
+	}
+	for _, tt := range tests {
+		data := ""
+		if tt.header.Size > 0 {
+			data = "x"
+		}
+		b, err := newBundle()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = b.Unpack(bytes.NewReader(testTar(t, tt.header, data)))
+		if tt.fail {
+			if err == nil {
+				t.Errorf("%s: bundle is accepted", tt.name)
+			}
+		} else if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		} else if len(b.Models) != 1 || b.Models[0] != "model" {
+			t.Errorf("%s: unexpected bundle models %v", tt.name, b.Models)
+		}
+		// nothing should be written outside of model areas
+		for _, fname := range []string{"labels.txt", "../labels.txt", "model/" + EvaluationFile} {
+			if _, err := os.Lstat(filepath.Join(b.Root, fname)); err == nil {
+				t.Errorf("%s: bundle writes %s", tt.name, fname)
+			}
+		}
+		if tt.header.Typeflag == tar.TypeSymlink {
+			if info, err := os.Lstat(filepath.Join(b.Root, tt.header.Name)); err == nil && info.Mode()&os.ModeSymlink != 0 {
+				t.Errorf("%s: bundle creates symlink", tt.name)
+			}
+		}
+		b.Cleanup()
+	}
+}
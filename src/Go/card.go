@@ -0,0 +1,187 @@
+package main
+
+// card module provides model cards and per-model page of web UI
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	tf "github.com/galeone/tensorflow/tensorflow/go"
+	"github.com/gorilla/mux"
+)
+
+// ModelCardFile defines name of markdown model card within model area
+const ModelCardFile = "MODEL_CARD.md"
+
+// CardFile defines name of structured model card within model area
+const CardFile = "card.json"
+
+// max number of labels shown on model page
+const maxCardLabels = 100
+
+// ModelCard represents structured model card
+type ModelCard struct {
+	Overview       string   `json:"overview"`        // model overview
+	IntendedUse    string   `json:"intended_use"`    // intended use of the model
+	Limitations    string   `json:"limitations"`     // known limitations of the model
+	TrainingData   string   `json:"training_data"`   // description of training data
+	EvaluationData string   `json:"evaluation_data"` // description of evaluation data
+	Authors        []string `json:"authors"`         // model authors
+	License        string   `json:"license"`         // model license
+	References     []string `json:"references"`      // references, e.g. papers or notes
+}
+
+// ModelSignature represents input and output of the model, shapes are
+// known only for models loaded into the cache
+type ModelSignature struct {
+	Input       string // input node or layer
+	InputShape  string // input shape
+	Output      string // output node or layer
+	OutputShape string // output shape
+}
+
+// helper function to read model card of the model, it returns markdown
+// and/or structured model card if they are provided
+func readModelCard(name string) (string, *ModelCard, error) {
+	path := filepath.Join(_config.ModelDir, name)
+	var md string
+	data, err := ioutil.ReadFile(filepath.Join(path, ModelCardFile))
+	if err == nil {
+		md = string(data)
+	} else if !os.IsNotExist(err) {
+		return md, nil, err
+	}
+	data, err = ioutil.ReadFile(filepath.Join(path, CardFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return md, nil, nil
+		}
+		return md, nil, err
+	}
+	var card ModelCard
+	if err := json.Unmarshal(data, &card); err != nil {
+		return md, nil, err
+	}
+	return md, &card, nil
+}
+
+// helper function to get shape of given graph node
+func nodeShape(graph *tf.Graph, node string) string {
+	if graph == nil || node == "" {
+		return ""
+	}
+	op := graph.Operation(node)
+	if op == nil || op.NumOutputs() == 0 {
+		return ""
+	}
+	return op.Output(0).Shape().String()
+}
+
+// helper function to get shape of given TF 2.X model layer
+func layerShape(tfm TFModel, layer string) string {
+	out, err := modelOp(tfm.Model, layer)
+	if err != nil {
+		return ""
+	}
+	return out.Shape().String()
+}
+
+// helper function to get input and output signature of the model
+func modelSignature(params TFParams, flavor string) ModelSignature {
+	var sig ModelSignature
+	if flavor == "tf2" {
+		sig.Input, sig.Output = params.InputName, params.OutputName
+		if sig.Input == "" {
+			sig.Input = DefaultInputName
+		}
+		if sig.Output == "" {
+			sig.Output = DefaultOutputName
+		}
+	} else {
+		sig.Input, sig.Output = params.InputNode, params.OutputNode
+	}
+	if !_cache.loaded(params.Name) {
+		return sig
+	}
+	tfm, release, err := _cache.acquire(params.Name)
+	if err != nil {
+		return sig
+	}
+	defer release()
+	if tfm.Model != nil {
+		sig.InputShape = layerShape(tfm, sig.Input)
+		sig.OutputShape = layerShape(tfm, sig.Output)
+	} else {
+		sig.InputShape = nodeShape(tfm.Graph, sig.Input)
+		sig.OutputShape = nodeShape(tfm.Graph, sig.Output)
+	}
+	return sig
+}
+
+// ModelPageHandler renders web page of the model with its model card,
+// parameters, signature, labels, metrics and version history
+func ModelPageHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["model"]
+	params, err := readParams(name)
+	if err != nil {
+		msg := fmt.Sprintf("unknown model %s", name)
+		responseError(w, msg, err, http.StatusNotFound)
+		return
+	}
+	params.Checksums = modelChecksums(name)
+	flavor, err := tfVersion(name)
+	if err != nil {
+		responseError(w, "unable to get model flavor", err, http.StatusInternalServerError)
+		return
+	}
+	tmplData := make(map[string]interface{})
+	tmplData["Base"] = _config.Base
+	tmplData["Model"] = params
+	tmplData["Flavor"] = flavor
+	md, card, err := readModelCard(name)
+	if err != nil {
+		log.Println("unable to read model card of", name, err)
+	}
+	tmplData["Markdown"] = md
+	tmplData["Card"] = card
+	if flavor != "pipeline" {
+		tmplData["Signature"] = modelSignature(params, flavor)
+	}
+	switch flavor {
+	case "tf1":
+		tmplData["GraphFile"] = params.Model
+	case "tf2":
+		tmplData["GraphFile"] = "saved_model.pb"
+	}
+	if params.Labels != "" && filepath.IsLocal(params.Labels) {
+		labels, err := readLabels(filepath.Join(_config.ModelDir, name, params.Labels))
+		if err == nil {
+			tmplData["NLabels"] = len(labels)
+			if len(labels) > maxCardLabels {
+				labels = labels[:maxCardLabels]
+			}
+			tmplData["Labels"] = labels
+		}
+	}
+	if eval, err := readEvaluation(name); err == nil {
+		tmplData["Evaluation"] = eval
+	}
+	if history, err := modelHistory(name); err == nil {
+		tmplData["History"] = history
+	}
+	if flavor == "pipeline" {
+		if p, err := getPipeline(name); err == nil {
+			tmplData["Pipeline"] = p
+		}
+	}
+	var templates Templates
+	page := templates.Model(_tmplDir, tmplData)
+	header, footer := pageTemplates()
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(header + page + footer))
+}
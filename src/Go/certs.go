@@ -0,0 +1,383 @@
+package main
+
+// certs module provides TLS configuration of the server and hot reload of
+// server certificate, client CAs and CRLs
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// modes of client certificate verification
+const (
+	ClientAuthRequest = "request"         // request certificate and verify it if CAs are configured or authentication is enabled
+	ClientAuthVerify  = "verify-if-given" // verify certificate if client provides it
+	ClientAuthRequire = "require"         // require and verify client certificate
+)
+
+// quiet period before we reload changed certificates
+const certsReloadDelay = time.Second
+
+// names of CA certificates and CRLs in hashed CA directory, e.g.
+// /etc/grid-security/certificates/1d879c6c.0 and 1d879c6c.r0
+var (
+	hashedCA  = regexp.MustCompile(`^[0-9a-f]{8}\.[0-9]+$`)
+	hashedCRL = regexp.MustCompile(`^[0-9a-f]{8}\.r[0-9]+$`)
+)
+
+// ServerCerts keeps server certificate, client CAs and revoked client
+// certificates, they are reloaded on file change or SIGHUP
+type ServerCerts struct {
+	Cert    *tls.Certificate           // server certificate
+	CAs     *x509.CertPool             // CAs used to verify clients, system CAs are used if it is not set
+	Revoked map[string]map[string]bool // issuer => serial numbers of revoked certificates
+	mu      sync.RWMutex
+}
+
+// global server certificates
+var _serverCerts ServerCerts
+
+// helper function to read PEM certificates from the file
+func readCerts(fname string) ([]*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", fname, err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("%s does not contain any PEM certificate", fname)
+	}
+	return certs, nil
+}
+
+// helper function to read CRL in PEM or DER format from the file
+func readCRL(fname string) (*x509.RevocationList, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+	crl, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fname, err)
+	}
+	return crl, nil
+}
+
+// helper function to load client CAs from PEM bundle and hashed CA directory
+// as well as revoked certificates from CRLs, CRLs are accepted only if they
+// are signed by one of the CAs
+func loadClientCAs(caFile, caDir string, crlFiles []string) (*x509.CertPool, map[string]map[string]bool, error) {
+	var cas []*x509.Certificate
+	if caFile != "" {
+		certs, err := readCerts(caFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		cas = append(cas, certs...)
+	}
+	crlFiles = append([]string{}, crlFiles...)
+	if caDir != "" {
+		entries, err := ioutil.ReadDir(caDir)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			fname := filepath.Join(caDir, name)
+			switch {
+			case hashedCA.MatchString(name) || strings.HasSuffix(name, ".pem"):
+				certs, err := readCerts(fname)
+				if err != nil {
+					// hashed directories may contain broken links of removed CAs
+					log.Println("skip client CA", err)
+					continue
+				}
+				cas = append(cas, certs...)
+			case hashedCRL.MatchString(name) || strings.HasSuffix(name, ".crl"):
+				crlFiles = append(crlFiles, fname)
+			}
+		}
+	}
+	if len(cas) == 0 {
+		if len(crlFiles) > 0 {
+			return nil, nil, errors.New("CRLs require client CAs")
+		}
+		return nil, nil, nil
+	}
+	pool := x509.NewCertPool()
+	for _, cert := range cas {
+		pool.AddCert(cert)
+	}
+	revoked := make(map[string]map[string]bool)
+	for _, fname := range crlFiles {
+		crl, err := readCRL(fname)
+		if err != nil {
+			log.Println("skip CRL", err)
+			continue
+		}
+		var issuer *x509.Certificate
+		for _, cert := range cas {
+			if bytes.Equal(crl.RawIssuer, cert.RawSubject) && crl.CheckSignatureFrom(cert) == nil {
+				issuer = cert
+				break
+			}
+		}
+		if issuer == nil {
+			log.Printf("skip CRL %s, it is not signed by any of client CAs", fname)
+			continue
+		}
+		if !crl.NextUpdate.IsZero() && time.Now().After(crl.NextUpdate) {
+			log.Printf("CRL %s of %s is expired since %v", fname, certDN(issuer), crl.NextUpdate)
+		}
+		serials, ok := revoked[string(crl.RawIssuer)]
+		if !ok {
+			serials = make(map[string]bool)
+			revoked[string(crl.RawIssuer)] = serials
+		}
+		for _, rec := range crl.RevokedCertificates {
+			serials[rec.SerialNumber.String()] = true
+		}
+	}
+	return pool, revoked, nil
+}
+
+// load reads server certificate, client CAs and CRLs from configured files,
+// previous state is kept if any of them can't be loaded
+func (s *ServerCerts) load() error {
+	var cert *tls.Certificate
+	_, e1 := os.Stat(_config.ServerCrt)
+	_, e2 := os.Stat(_config.ServerKey)
+	if e1 == nil && e2 == nil {
+		c, err := tls.LoadX509KeyPair(_config.ServerCrt, _config.ServerKey)
+		if err != nil {
+			return err
+		}
+		if leaf, err := x509.ParseCertificate(c.Certificate[0]); err == nil {
+			log.Printf("server certificate %s expires on %v", certDN(leaf), leaf.NotAfter)
+		}
+		cert = &c
+	} else if s.certificateLoaded() {
+		// HTTPs server can't switch to HTTP, files are probably being replaced
+		return errors.New("server certificate or key file is missing")
+	}
+	cas, revoked, err := loadClientCAs(_config.ClientCAs, _config.ClientCADir, _config.ClientCRLs)
+	if err != nil {
+		return err
+	}
+	if cas == nil && clientCAsRequired() {
+		return errors.New("client CAs are required to verify client certificates, set clientCAs or clientCADir")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Cert = cert
+	s.CAs = cas
+	s.Revoked = revoked
+	return nil
+}
+
+// helper function to check if client CAs are required, i.e. client
+// certificates are verified either because authentication is required or
+// because of client auth mode, system CAs are never used to verify clients
+func clientCAsRequired() bool {
+	return _config.Auth || _config.ClientAuth == ClientAuthVerify || _config.ClientAuth == ClientAuthRequire
+}
+
+// certificate returns current server certificate, it is used as
+// tls.Config.GetCertificate
+func (s *ServerCerts) certificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.Cert == nil {
+		return nil, errors.New("server certificate is not loaded")
+	}
+	return s.Cert, nil
+}
+
+// helper function to check if server certificate is loaded
+func (s *ServerCerts) certificateLoaded() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Cert != nil
+}
+
+// clientCAs returns current pool of client CAs
+func (s *ServerCerts) clientCAs() *x509.CertPool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.CAs
+}
+
+// checkRevoked checks that none of the chain certificates is revoked
+func (s *ServerCerts) checkRevoked(chain []*x509.Certificate) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, cert := range chain {
+		if s.Revoked[string(cert.RawIssuer)][cert.SerialNumber.String()] {
+			return fmt.Errorf("certificate %s is revoked", certDN(cert))
+		}
+	}
+	return nil
+}
+
+// helper function to get TLS version from its name, e.g. 1.2
+func tlsVersion(name string) (uint16, error) {
+	switch strings.TrimPrefix(strings.ToLower(name), "tls") {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %s", name)
+}
+
+// helper function to get identifiers of cipher suites from their names,
+// e.g. TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384, insecure cipher suites are
+// not accepted
+func cipherSuites(names []string) ([]uint16, error) {
+	var ids []uint16
+	for _, name := range names {
+		found := false
+		for _, suite := range tls.CipherSuites() {
+			if suite.Name == name {
+				ids = append(ids, suite.ID)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %s", name)
+		}
+	}
+	return ids, nil
+}
+
+// helper function to create TLS configuration of the server, client
+// certificates are verified by verifyPeerCertificate since standard
+// verification does not accept grid proxies, in request and verify-if-given
+// modes certificates are not required such that unauthenticated requests get
+// proper HTTP error
+func serverTLSConfig() (*tls.Config, error) {
+	version, err := tlsVersion(_config.MinTLSVersion)
+	if err != nil {
+		return nil, err
+	}
+	ciphers, err := cipherSuites(_config.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		MinVersion:     version,
+		CipherSuites:   ciphers,
+		ClientAuth:     tls.RequestClientCert,
+		GetCertificate: _serverCerts.certificate,
+	}
+	if _config.ClientAuth == ClientAuthRequire {
+		config.ClientAuth = tls.RequireAnyClientCert
+	}
+	// client CAs may appear on reload, therefore verification is decided
+	// during every handshake
+	config.VerifyPeerCertificate = verifyPeerCertificate
+	return config, nil
+}
+
+// helper function to reload server certificates, client CAs and CRLs on
+// SIGHUP or when files in their directories are changed, e.g. by fetch-crl
+// or certificate renewal
+func watchCerts() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	var events <-chan fsnotify.Event
+	var errs <-chan error
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Println("unable to watch certificates", err)
+	} else {
+		events, errs = watcher.Events, watcher.Errors
+		dirs := make(map[string]bool)
+		for _, fname := range append([]string{_config.ServerCrt, _config.ServerKey, _config.ClientCAs}, _config.ClientCRLs...) {
+			if fname != "" {
+				dirs[filepath.Dir(fname)] = true
+			}
+		}
+		if _config.ClientCADir != "" {
+			dirs[_config.ClientCADir] = true
+		}
+		for dir := range dirs {
+			if err := watcher.Add(dir); err != nil {
+				log.Println("unable to watch", dir, err)
+			}
+		}
+	}
+	timer := time.NewTimer(certsReloadDelay)
+	timer.Stop()
+	reload := func(reason string) {
+		if err := _serverCerts.load(); err != nil {
+			// keep serving previous certificates
+			log.Printf("unable to reload certificates on %s: %v", reason, err)
+			return
+		}
+		log.Println("certificates are reloaded on", reason)
+	}
+	for {
+		select {
+		case <-hup:
+			reload("SIGHUP")
+		case event, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			if VERBOSE > 1 {
+				log.Println("certificates watcher event", event)
+			}
+			// certificates are usually replaced file by file
+			timer.Reset(certsReloadDelay)
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			log.Println("certificates watcher error", err)
+		case <-timer.C:
+			reload("file change")
+		}
+	}
+}
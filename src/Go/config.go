@@ -12,23 +12,72 @@ var _config Configuration
 
 // Configuration stores dbs configuration parameters
 type Configuration struct {
-	Port             int    `json:"port"`        // dbs port number
-	ModelDir         string `json:"modelDir"`    // location of model directory
-	StaticDir        string `json:"staticDir"`   // speficy static dir location
-	ConfigProto      string `json:"configProto"` // TF config proto file to use
-	Base             string `json:"base"`        // dbs base path
-	LogFile          string `json:"logFile"`     // log file
-	Verbose          int    `json:"verbose"`     // verbosity level
-	ServerKey        string `json:"serverKey"`   // server key for https
-	ServerCrt        string `json:"serverCrt"`   // server certificate for https
-	CacheLimit       int    `json:"cacheLimit"`  // number of TFModels to keep in cache
-	LimiterPeriod    string `json:"rate"`        // github.com/ulule/limiter rate value
-	PrintMonitRecord bool   `json:"monitRecord"` // print monit record on stdout
+	Port              int                    `json:"port"`              // dbs port number
+	ModelDir          string                 `json:"modelDir"`          // location of model directory
+	StaticDir         string                 `json:"staticDir"`         // speficy static dir location
+	ConfigProto       string                 `json:"configProto"`       // TF config proto file to use
+	Base              string                 `json:"base"`              // dbs base path
+	LogFile           string                 `json:"logFile"`           // log file
+	Verbose           int                    `json:"verbose"`           // verbosity level
+	ServerKey         string                 `json:"serverKey"`         // server key for https
+	ServerCrt         string                 `json:"serverCrt"`         // server certificate for https
+	CacheLimit        int                    `json:"cacheLimit"`        // number of TFModels to keep in cache
+	LimiterPeriod     string                 `json:"rate"`              // github.com/ulule/limiter rate value of all requests of a client
+	IPLimiterPeriod   string                 `json:"ipRate"`            // rate of all requests of an IP address applied before authentication, default is rate value
+	RateLimits        map[string]string      `json:"rateLimits"`        // route group (read, predict, upload or admin) => rate of a client
+	ModelRateLimits   map[string]string      `json:"modelRateLimits"`   // model => rate of predictions of a client
+	Quotas            map[string]Quota       `json:"quotas"`            // group => daily quota shared by its members, "*" for quota of every client
+	Concurrency       Concurrency            `json:"concurrency"`       // default concurrency limits of models
+	ModelConcurrency  map[string]Concurrency `json:"modelConcurrency"`  // model => concurrency limits
+	RequestTimeout    int                    `json:"requestTimeout"`    // default deadline of prediction requests in milliseconds, zero means no deadline
+	ReadTimeout       int                    `json:"readTimeout"`       // max time in seconds to read HTTP request including its body, zero means no limit
+	ReadHeaderTimeout int                    `json:"readHeaderTimeout"` // max time in seconds to read HTTP request headers, default 10
+	WriteTimeout      int                    `json:"writeTimeout"`      // max time in seconds to write HTTP response, zero means no limit
+	IdleTimeout       int                    `json:"idleTimeout"`       // max time in seconds to keep idle connection, default 120
+	ShutdownTimeout   int                    `json:"shutdownTimeout"`   // grace period in seconds to drain requests on shutdown, default 30
+	DrainDelay        int                    `json:"drainDelay"`        // time in seconds to keep serving requests as not ready server on shutdown
+	PrintMonitRecord  bool                   `json:"monitRecord"`       // print monit record on stdout
+	WatchModels       bool                   `json:"watchModels"`       // watch model directory and reload changed models
+	WatchDelay        int                    `json:"watchDelay"`        // quiet period in seconds before we reload changed model
+	Preload           []string               `json:"preload"`           // list of models to load and warm-up at startup
+	ReadyModels       []string               `json:"readyModels"`       // models which should be loaded before server is ready, in addition to preloaded ones
+	ReadyChecks       []string               `json:"readyChecks"`       // checks of readiness probe: modelDir, models and inference, default modelDir and models
+	CacheMemory       int64                  `json:"cacheMemory"`       // memory budget of models cache in MB
+	IdleTTL           int                    `json:"idleTTL"`           // unload models idle longer than given number of seconds
+	Admins            []string               `json:"admins"`            // list of admin DNs
+	TrustLocalhost    bool                   `json:"trustLocalhost"`    // grant admin role to requests from local host without X-Forwarded-For header
+	MaxBundleSize     int64                  `json:"maxBundleSize"`     // max size of uploaded bundle in MB
+	UploadTTL         int                    `json:"uploadTTL"`         // remove upload sessions idle longer than given number of seconds
+	ImportDirs        []string               `json:"importDirs"`        // areas of local file system allowed to import bundles from
+	ImportHosts       []string               `json:"importHosts"`       // hosts allowed to import bundles from, by default only public addresses are allowed
+	ImportTimeout     int                    `json:"importTimeout"`     // max time in seconds to fetch imported bundle, default 3600
+	MaxImports        int                    `json:"maxImports"`        // max number of unfinished import jobs, default 4
+	TrustedKeys       []string               `json:"trustedKeys"`       // files with ed25519 public keys trusted to sign models
+	RequireSignature  bool                   `json:"requireSignature"`  // require signed models
+	Auth              bool                   `json:"auth"`              // require x509 authentication of clients
+	ClientCAs         string                 `json:"clientCAs"`         // file with PEM bundle of CAs used to verify client certificates
+	ClientCADir       string                 `json:"clientCADir"`       // hashed directory of client CAs and CRLs, e.g. /etc/grid-security/certificates
+	ClientCRLs        []string               `json:"clientCRLs"`        // files with CRLs of client CAs
+	ClientAuth        string                 `json:"clientAuth"`        // client certificate mode: request, verify-if-given or require
+	MinTLSVersion     string                 `json:"minTLSVersion"`     // minimal TLS version, default 1.2
+	CipherSuites      []string               `json:"cipherSuites"`      // allowed TLS 1.2 cipher suites, Go defaults are used if empty
+	AuthDNs           string                 `json:"authDNs"`           // file or HTTP(s) URL with list of authorized DNs
+	AuthTTL           int                    `json:"authTTL"`           // time in seconds to cache list of authorized DNs
+	Roles             map[string][]string    `json:"roles"`             // role => list of DNs, "group:<name>" or "*" for any authenticated user
+	Groups            map[string][]string    `json:"groups"`            // group => list of its member DNs
+	DefaultRole       string                 `json:"defaultRole"`       // role of anonymous clients, "none" denies access
+	APIKeys           string                 `json:"apiKeys"`           // file with hashes of issued API keys, should be outside of model directory
+	JWKS              string                 `json:"jwks"`              // JWKS file with public keys used to verify JWT tokens
+	JWTSecret         string                 `json:"jwtSecret"`         // file with shared secret used to verify HMAC signed JWT tokens
+	JWTIssuer         string                 `json:"jwtIssuer"`         // expected issuer (iss claim) of JWT tokens
+	JWTAudience       string                 `json:"jwtAudience"`       // expected audience (aud claim) of JWT tokens
+	JWTUserClaim      string                 `json:"jwtUserClaim"`      // JWT claim with user name, default sub
+	JWTGroupsClaim    string                 `json:"jwtGroupsClaim"`    // JWT claim with user groups, default groups
 }
 
 // String returns string representation of server configuration
 func (c *Configuration) String() string {
-	return fmt.Sprintf("config port=%d modelDir=%s staticDir=%s base=%s proto=%s verbose=%d log=%s crt=%s key=%s rate=%s", c.Port, c.ModelDir, c.StaticDir, c.Base, c.ConfigProto, c.Verbose, c.LogFile, c.ServerCrt, c.ServerKey, c.LimiterPeriod)
+	return fmt.Sprintf("config port=%d modelDir=%s staticDir=%s base=%s proto=%s verbose=%d log=%s crt=%s key=%s rate=%s watch=%v", c.Port, c.ModelDir, c.StaticDir, c.Base, c.ConfigProto, c.Verbose, c.LogFile, c.ServerCrt, c.ServerKey, c.LimiterPeriod, c.WatchModels)
 }
 
 // helper function to parse configuration file
@@ -46,6 +95,48 @@ func parseConfig(configFile string) error {
 	if _config.LimiterPeriod == "" {
 		_config.LimiterPeriod = "100-S"
 	}
+	if _config.IPLimiterPeriod == "" {
+		_config.IPLimiterPeriod = _config.LimiterPeriod
+	}
+	if _config.MaxBundleSize == 0 {
+		_config.MaxBundleSize = 4096
+	}
+	if _config.UploadTTL == 0 {
+		_config.UploadTTL = 86400
+	}
+	if _config.ImportTimeout == 0 {
+		_config.ImportTimeout = 3600
+	}
+	if _config.MaxImports == 0 {
+		_config.MaxImports = 4
+	}
+	if _config.DefaultRole == "" {
+		_config.DefaultRole = RolePredictor
+	}
+	if _config.ClientAuth == "" {
+		_config.ClientAuth = ClientAuthRequest
+	}
+	if _config.AuthTTL == 0 {
+		_config.AuthTTL = 3600
+	}
+	if _config.JWTUserClaim == "" {
+		_config.JWTUserClaim = "sub"
+	}
+	if _config.JWTGroupsClaim == "" {
+		_config.JWTGroupsClaim = "groups"
+	}
+	if _config.WatchDelay == 0 {
+		_config.WatchDelay = 5
+	}
+	if _config.ReadHeaderTimeout == 0 {
+		_config.ReadHeaderTimeout = 10
+	}
+	if _config.IdleTimeout == 0 {
+		_config.IdleTimeout = 120
+	}
+	if _config.ShutdownTimeout == 0 {
+		_config.ShutdownTimeout = 30
+	}
 	log.Println(_config.String())
 	return nil
 }
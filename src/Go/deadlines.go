@@ -0,0 +1,231 @@
+package main
+
+// deadlines module provides request deadlines and cancellation of inference
+// requests whose clients have gone away
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// StatusClientClosedRequest is logged for requests cancelled by their
+// clients (nginx convention), clients do not get the response
+const StatusClientClosedRequest = 499
+
+// Timing represents timing of request which exceeded its deadline
+type Timing struct {
+	Deadline  float64 `json:"deadline"`  // request deadline in seconds
+	Queue     float64 `json:"queue"`     // time spent in model queues in seconds
+	Inference float64 `json:"inference"` // time spent in inference in seconds
+	Total     float64 `json:"total"`     // total time in seconds
+	Stage     string  `json:"stage"`     // stage which exceeded the deadline: queue or inference
+}
+
+// DeadlineError is returned when request exceeds its deadline
+type DeadlineError struct {
+	Timing Timing
+}
+
+// Error returns string representation of deadline error
+func (e *DeadlineError) Error() string {
+	return fmt.Sprintf("request deadline of %gs is exceeded in %s", e.Timing.Deadline, e.Timing.Stage)
+}
+
+// Inference represents inference request admitted to model queues along
+// with its deadline
+type Inference struct {
+	ctx      context.Context    // request context with deadline
+	cancel   context.CancelFunc // cancels inference once request is finished
+	release  func()             // releases inference slots of models
+	timeout  time.Duration      // request deadline, zero means no deadline
+	start    time.Time          // time when request entered model queues
+	admitted time.Time          // time when request got inference slots
+	started  time.Time          // time when inference started
+	once     sync.Once
+}
+
+// helper function to parse request timeout, it accepts Go durations,
+// e.g. 500ms, or number of seconds
+func parseTimeout(value string) (time.Duration, error) {
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, e := strconv.ParseFloat(value, 64)
+		if e != nil {
+			return 0, fmt.Errorf("invalid timeout %s", value)
+		}
+		timeout = time.Duration(seconds * float64(time.Second))
+	}
+	if timeout <= 0 {
+		return 0, fmt.Errorf("invalid timeout %s", value)
+	}
+	return timeout, nil
+}
+
+// helper function to get deadline of HTTP request from X-Request-Timeout
+// header or timeout query parameter, the deadline is capped by max
+// timeouts of given models
+func requestTimeout(r *http.Request, models []string) (time.Duration, error) {
+	timeout := time.Duration(_config.RequestTimeout) * time.Millisecond
+	value := r.Header.Get("X-Request-Timeout")
+	if value == "" {
+		value = r.URL.Query().Get("timeout")
+	}
+	if value != "" {
+		t, err := parseTimeout(value)
+		if err != nil {
+			return 0, err
+		}
+		timeout = t
+	}
+	for _, name := range models {
+		limit := time.Duration(modelConcurrency(name).MaxTimeout) * time.Millisecond
+		if limit > 0 && (timeout == 0 || timeout > limit) {
+			timeout = limit
+		}
+	}
+	return timeout, nil
+}
+
+// helper function to admit HTTP request to inference of given models, it
+// waits for inference slots of the models until request deadline and returns
+// false along with error response if request can't be admitted, callers
+// should close admitted inference once they are finished
+func admit(w http.ResponseWriter, r *http.Request, models ...string) (*Inference, bool) {
+	timeout, err := requestTimeout(r, models)
+	if err != nil {
+		responseError(w, err.Error(), err, http.StatusBadRequest)
+		return nil, false
+	}
+	inf := &Inference{timeout: timeout, start: time.Now()}
+	if timeout > 0 {
+		inf.ctx, inf.cancel = context.WithTimeout(r.Context(), timeout)
+	} else {
+		inf.ctx, inf.cancel = context.WithCancel(r.Context())
+	}
+	release, model, err := acquireModels(inf.ctx, requestPriority(r), models)
+	if err != nil {
+		inf.cancel()
+		if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+			responsePredictionError(w, fmt.Sprintf("model %s is not available", model), inf.contextError(err))
+			return nil, false
+		}
+		w.Header().Set("Retry-After", "1")
+		msg := fmt.Sprintf("model %s is overloaded: %v", model, err)
+		responseError(w, msg, err, http.StatusServiceUnavailable)
+		return nil, false
+	}
+	inf.release = release
+	inf.admitted = time.Now()
+	return inf, true
+}
+
+// helper function to get timing of the request
+func (inf *Inference) timing() Timing {
+	now := time.Now()
+	t := Timing{Deadline: inf.timeout.Seconds(), Total: now.Sub(inf.start).Seconds(), Stage: "queue"}
+	if !inf.admitted.IsZero() {
+		t.Queue = inf.admitted.Sub(inf.start).Seconds()
+	} else {
+		t.Queue = t.Total
+	}
+	if !inf.started.IsZero() {
+		t.Inference = now.Sub(inf.started).Seconds()
+		t.Stage = "inference"
+	}
+	return t
+}
+
+// helper function to convert context error into deadline error along with
+// timing of the request
+func (inf *Inference) contextError(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return &DeadlineError{Timing: inf.timing()}
+	}
+	return err
+}
+
+// run executes inference function unless request deadline is exceeded or
+// client has gone away, TF sessions can't be interrupted therefore inference
+// keeps running in background after deadline and holds inference slots of
+// the models until it is finished
+func (inf *Inference) run(fn func(ctx context.Context) error) error {
+	if inf == nil {
+		return fn(context.Background())
+	}
+	inf.started = time.Now()
+	if err := inf.ctx.Err(); err != nil {
+		// skip inference of requests whose clients have gone away
+		inf.once.Do(inf.release)
+		return inf.contextError(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		defer inf.once.Do(inf.release)
+		done <- fn(inf.ctx)
+	}()
+	select {
+	case err := <-done:
+		if err != nil && inf.ctx.Err() != nil {
+			// inference was interrupted, e.g. between pipeline stages
+			return inf.contextError(inf.ctx.Err())
+		}
+		return err
+	case <-inf.ctx.Done():
+		return inf.contextError(inf.ctx.Err())
+	}
+}
+
+// close finishes the request, it releases inference slots if inference was
+// not started and cancels remaining work of the request, e.g. pipeline stages
+func (inf *Inference) close() {
+	if inf == nil {
+		return
+	}
+	inf.cancel()
+	if inf.started.IsZero() {
+		inf.once.Do(inf.release)
+	}
+}
+
+// context key of admitted inference
+type inferenceKey struct{}
+
+// helper function to store admitted inference in HTTP request
+func withInference(r *http.Request, inf *Inference) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), inferenceKey{}, inf))
+}
+
+// helper function to get admitted inference of HTTP request
+func requestInference(r *http.Request) *Inference {
+	inf, _ := r.Context().Value(inferenceKey{}).(*Inference)
+	return inf
+}
+
+// helper function to provide response for requests which exceeded their
+// deadline or were cancelled by their clients
+func responseDeadlineError(w http.ResponseWriter, msg string, err error) bool {
+	var derr *DeadlineError
+	if errors.As(err, &derr) {
+		log.Println("ERROR", msg, err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusGatewayTimeout)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":  fmt.Sprintf("%s: %v", msg, derr),
+			"timing": derr.Timing,
+		})
+		return true
+	}
+	if errors.Is(err, context.Canceled) {
+		log.Println("request is cancelled by the client", msg)
+		w.WriteHeader(StatusClientClosedRequest)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,244 @@
+package main
+
+// evaluate module provides quality gates of uploaded models based on their
+// golden test vectors
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// TestDataFile defines default name of test dataset file within model area
+const TestDataFile = "testdata.json"
+
+// EvaluationFile defines name of evaluation report stored within model area
+const EvaluationFile = "evaluation.json"
+
+// TestSpec represents test dataset and quality gates of the model, e.g.
+// "test": {"file": "testdata.json", "max_abs_dev": 1e-5, "min_accuracy": 0.9, "min_auc": 0.8}
+// zero threshold disables its gate
+type TestSpec struct {
+	File        string  `json:"file"`         // test dataset file name
+	MaxAbsDev   float64 `json:"max_abs_dev"`  // max absolute deviation from expected outputs
+	MinAccuracy float64 `json:"min_accuracy"` // min accuracy with respect to labels
+	MinAUC      float64 `json:"min_auc"`      // min AUC of binary classifier
+}
+
+// TestSample represents single test vector, i.e. model inputs along with
+// expected model outputs and/or label (index of expected class)
+type TestSample struct {
+	Values   []float32 `json:"values"`   // model inputs
+	Expected []float32 `json:"expected"` // expected model outputs
+	Label    *int      `json:"label"`    // expected class
+}
+
+// Evaluation represents evaluation report of the model on its test dataset
+type Evaluation struct {
+	Model     string   `json:"model"`                 // model name
+	Version   string   `json:"version"`               // model version
+	Samples   int      `json:"samples"`               // number of test samples
+	MaxAbsDev *float64 `json:"max_abs_dev,omitempty"` // max absolute deviation from expected outputs
+	Accuracy  *float64 `json:"accuracy,omitempty"`    // accuracy with respect to labels
+	AUC       *float64 `json:"auc,omitempty"`         // AUC of binary classifier
+	Gates     TestSpec `json:"gates"`                 // quality gates
+	Passed    bool     `json:"passed"`                // all quality gates are passed
+	Failures  []string `json:"failures"`              // failed quality gates
+	TimeStamp string   `json:"timestamp"`             // evaluation timestamp
+}
+
+// helper function to read test dataset of the model in given model area
+func testSamples(path string, spec *TestSpec) ([]TestSample, error) {
+	var samples []TestSample
+	name := spec.File
+	if name == "" {
+		name = TestDataFile
+	}
+	if !validFileName(name) {
+		return samples, fmt.Errorf("invalid test dataset file name %s", name)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(path, name))
+	if err != nil {
+		return samples, err
+	}
+	err = json.Unmarshal(data, &samples)
+	return samples, err
+}
+
+// helper function to evaluate model on its test dataset, failed quality
+// gates are reported as validation errors which prevents model activation
+func evaluateModel(path string, params TFParams, runner *modelRunner, report *ModelReport) {
+	samples, err := testSamples(path, params.Test)
+	if err != nil {
+		report.errorf("unable to read test dataset: %v", err)
+		return
+	}
+	if len(samples) == 0 {
+		report.errorf("test dataset does not contain any sample")
+		return
+	}
+	var predictions [][]float32
+	for i, s := range samples {
+		probs, err := runner.predict(s.Values)
+		if err != nil {
+			report.errorf("test sample %d: %v", i, err)
+			return
+		}
+		predictions = append(predictions, probs)
+	}
+	eval := evaluate(samples, predictions, *params.Test)
+	eval.Model = params.Name
+	eval.Version = params.Version
+	report.Evaluation = &eval
+	for _, msg := range eval.Failures {
+		report.errorf("quality gate failed: %s", msg)
+	}
+}
+
+// helper function to compute evaluation metrics and check quality gates
+func evaluate(samples []TestSample, predictions [][]float32, spec TestSpec) Evaluation {
+	eval := Evaluation{Samples: len(samples), Gates: spec, TimeStamp: time.Now().String()}
+	var maxDev float64
+	var nexp, nlabels, correct int
+	var scores []float64
+	var classes []int
+	binary := true
+	for i, s := range samples {
+		probs := predictions[i]
+		if len(s.Expected) > 0 {
+			if len(s.Expected) != len(probs) {
+				eval.Failures = append(eval.Failures,
+					fmt.Sprintf("sample %d provides %d expected outputs while model returns %d", i, len(s.Expected), len(probs)))
+				continue
+			}
+			nexp++
+			for j, v := range s.Expected {
+				maxDev = math.Max(maxDev, math.Abs(float64(probs[j])-float64(v)))
+			}
+		}
+		if s.Label == nil || len(probs) == 0 {
+			continue
+		}
+		nlabels++
+		if predictedClass(probs) == *s.Label {
+			correct++
+		}
+		// binary heads provide either single probability or two classes
+		if len(probs) > 2 || (*s.Label != 0 && *s.Label != 1) {
+			binary = false
+			continue
+		}
+		scores = append(scores, float64(probs[len(probs)-1]))
+		classes = append(classes, *s.Label)
+	}
+	if nexp > 0 {
+		eval.MaxAbsDev = &maxDev
+	}
+	if nlabels > 0 {
+		accuracy := float64(correct) / float64(nlabels)
+		eval.Accuracy = &accuracy
+	}
+	if binary && len(scores) > 0 {
+		if auc, ok := rocAUC(scores, classes); ok {
+			eval.AUC = &auc
+		}
+	}
+
+	// check quality gates
+	if spec.MaxAbsDev > 0 {
+		if eval.MaxAbsDev == nil {
+			eval.Failures = append(eval.Failures, "test dataset does not provide expected outputs")
+		} else if *eval.MaxAbsDev > spec.MaxAbsDev {
+			eval.Failures = append(eval.Failures,
+				fmt.Sprintf("max abs deviation %g exceeds %g", *eval.MaxAbsDev, spec.MaxAbsDev))
+		}
+	}
+	if spec.MinAccuracy > 0 {
+		if eval.Accuracy == nil {
+			eval.Failures = append(eval.Failures, "test dataset does not provide labels")
+		} else if *eval.Accuracy < spec.MinAccuracy {
+			eval.Failures = append(eval.Failures,
+				fmt.Sprintf("accuracy %g is below %g", *eval.Accuracy, spec.MinAccuracy))
+		}
+	}
+	if spec.MinAUC > 0 {
+		if eval.AUC == nil {
+			eval.Failures = append(eval.Failures, "AUC requires binary model with labels of both classes")
+		} else if *eval.AUC < spec.MinAUC {
+			eval.Failures = append(eval.Failures,
+				fmt.Sprintf("AUC %g is below %g", *eval.AUC, spec.MinAUC))
+		}
+	}
+	eval.Passed = len(eval.Failures) == 0
+	return eval
+}
+
+// helper function to get predicted class, single output is treated as
+// probability of positive class
+func predictedClass(probs []float32) int {
+	if len(probs) == 1 {
+		if probs[0] >= 0.5 {
+			return 1
+		}
+		return 0
+	}
+	return argmax(probs)
+}
+
+// helper function to compute area under ROC curve using Mann-Whitney
+// statistic, ties get average rank
+func rocAUC(scores []float64, classes []int) (float64, bool) {
+	idx := make([]int, len(scores))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.Slice(idx, func(i, j int) bool { return scores[idx[i]] < scores[idx[j]] })
+	var npos, nneg int
+	var rankSum float64
+	for i := 0; i < len(idx); {
+		j := i
+		for j < len(idx) && scores[idx[j]] == scores[idx[i]] {
+			j++
+		}
+		rank := float64(i+j+1) / 2 // average of ranks i+1..j
+		for k := i; k < j; k++ {
+			if classes[idx[k]] == 1 {
+				npos++
+				rankSum += rank
+			} else {
+				nneg++
+			}
+		}
+		i = j
+	}
+	if npos == 0 || nneg == 0 {
+		return 0, false
+	}
+	auc := (rankSum - float64(npos*(npos+1))/2) / float64(npos*nneg)
+	return auc, true
+}
+
+// helper function to store evaluation report within given model area
+func writeEvaluation(path string, eval *Evaluation) error {
+	data, err := json.MarshalIndent(eval, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(path, EvaluationFile), data, 0644)
+}
+
+// helper function to read evaluation report of the model
+func readEvaluation(name string) (Evaluation, error) {
+	var eval Evaluation
+	fname := fmt.Sprintf("%s/%s/%s", _config.ModelDir, name, EvaluationFile)
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return eval, err
+	}
+	err = json.Unmarshal(data, &eval)
+	return eval, err
+}
@@ -0,0 +1,131 @@
+package main
+
+// export module provides export of models as bundles
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// helper function to write model area into tar archive, archive entries
+// use bundle layout, i.e. <model>/<file>, such that the archive can be
+// uploaded to another TFaaS server
+func writeModelArchive(tw *tar.Writer, name string) error {
+	// model area itself may be a symlink, e.g. to shared file system
+	path, err := filepath.EvalSymlinks(filepath.Join(_config.ModelDir, name))
+	if err != nil {
+		return err
+	}
+	return filepath.Walk(path, func(fname string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(path, fname)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			// bundles may contain only directories and regular files
+			log.Println("skip export of", fname)
+			return nil
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(filepath.Join(name, rel))
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		file, err := os.Open(fname)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.CopyN(tw, file, header.Size)
+		return err
+	})
+}
+
+// helper function to stream tar.gz archive of given models
+func exportModels(w io.Writer, names []string) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, name := range names {
+		if err := writeModelArchive(tw, name); err != nil {
+			return fmt.Errorf("unable to export %s: %v", name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// helper function to list all models in model directory
+func modelNames() ([]string, error) {
+	var names []string
+	files, err := ioutil.ReadDir(_config.ModelDir)
+	if err != nil {
+		return names, err
+	}
+	for _, f := range files {
+		if isModelArea(f) {
+			names = append(names, f.Name())
+		}
+	}
+	return names, nil
+}
+
+// helper function to stream export archive to the client, the archive is
+// generated on the fly therefore errors can be only logged once we start
+// sending data
+func responseExport(w http.ResponseWriter, fname string, names []string) {
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", fname))
+	time0 := time.Now()
+	if err := exportModels(w, names); err != nil {
+		log.Println("ERROR unable to export models", err)
+		return
+	}
+	log.Printf("export %v models in %v", names, time.Since(time0))
+}
+
+// ExportHandler streams model bundle as tar.gz archive
+func ExportHandler(w http.ResponseWriter, r *http.Request) {
+	model := mux.Vars(r)["model"]
+	if _, err := tfVersion(model); err != nil {
+		msg := fmt.Sprintf("unknown model %s", model)
+		responseError(w, msg, err, http.StatusNotFound)
+		return
+	}
+	responseExport(w, fmt.Sprintf("%s.tar.gz", model), []string{model})
+}
+
+// ExportAllHandler streams all models of the repository as tar.gz archive,
+// e.g. for backups
+func ExportAllHandler(w http.ResponseWriter, r *http.Request) {
+	names, err := modelNames()
+	if err != nil {
+		responseError(w, "unable to read model directory", err, http.StatusInternalServerError)
+		return
+	}
+	fname := fmt.Sprintf("tfaas-%s.tar.gz", time.Now().Format("20060102-150405"))
+	responseExport(w, fname, names)
+}
@@ -3,6 +3,7 @@ module github.com/vkuznet/TFaaS
 go 1.20
 
 require (
+	github.com/fsnotify/fsnotify v1.6.0
 	github.com/galeone/tensorflow/tensorflow/go v0.0.0-20221023090153-6b7fa0680c3e
 	github.com/galeone/tfgo v0.0.0-20230214145115-56cedbc50978
 	github.com/golang/protobuf v1.5.2
@@ -11,6 +12,7 @@ require (
 	github.com/shirou/gopsutil v3.21.11+incompatible
 	github.com/ulule/limiter/v3 v3.11.0
 	github.com/vkuznet/x509proxy v0.0.0-20210801171832-e47b94db99b6
+	golang.org/x/sys v0.3.0
 )
 
 require (
@@ -21,6 +23,5 @@ require (
 	github.com/tklauser/go-sysconf v0.3.11 // indirect
 	github.com/tklauser/numcpus v0.6.0 // indirect
 	github.com/yusufpapurcu/wmi v1.2.2 // indirect
-	golang.org/x/sys v0.3.0 // indirect
 	google.golang.org/protobuf v1.28.1 // indirect
 )
@@ -0,0 +1,312 @@
+package main
+
+// graph module provides introspection of model graphs
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	tf "github.com/galeone/tensorflow/tensorflow/go"
+	"github.com/gorilla/mux"
+)
+
+// GraphOutput represents output of graph operation
+type GraphOutput struct {
+	Index int    `json:"index"` // output index
+	DType string `json:"dtype"` // output data type
+	Shape string `json:"shape"` // output shape, -1 denotes unknown dimension
+}
+
+// GraphOperation represents operation of the graph
+type GraphOperation struct {
+	Name    string        `json:"name"`    // operation name
+	Type    string        `json:"type"`    // operation type
+	Inputs  []string      `json:"inputs"`  // operation inputs, i.e. producer:index
+	Outputs []GraphOutput `json:"outputs"` // operation outputs
+}
+
+// TensorSpec represents input or output tensor of SavedModel signature
+type TensorSpec struct {
+	Name  string `json:"name"`  // tensor name, i.e. operation:index
+	DType string `json:"dtype"` // tensor data type
+	Shape string `json:"shape"` // tensor shape
+}
+
+// SignatureInfo represents SavedModel signature
+type SignatureInfo struct {
+	Key     string                `json:"key"`     // signature key, e.g. serving_default
+	Method  string                `json:"method"`  // signature method name
+	Inputs  map[string]TensorSpec `json:"inputs"`  // signature inputs
+	Outputs map[string]TensorSpec `json:"outputs"` // signature outputs
+}
+
+// GraphInfo represents introspection of model graph
+type GraphInfo struct {
+	Model            string           `json:"model"`             // model name
+	Flavor           string           `json:"flavor"`            // model flavor
+	NumOperations    int              `json:"num_operations"`    // number of graph operations
+	InputCandidates  []string         `json:"input_candidates"`  // candidates of input node
+	OutputCandidates []string         `json:"output_candidates"` // candidates of output node
+	Signatures       []SignatureInfo  `json:"signatures"`        // SavedModel signatures
+	Operations       []GraphOperation `json:"operations"`        // graph operations
+}
+
+// operation types which are never used as model outputs
+var nonOutputTypes = []string{
+	"Const", "NoOp", "Placeholder", "PlaceholderWithDefault",
+	"VarHandleOp", "VariableV2", "Variable", "VarIsInitializedOp",
+	"Assign", "AssignVariableOp", "SaveV2", "RestoreV2", "MergeV2Checkpoints",
+	"StringJoin", "ShardedFilename",
+}
+
+// helper function to get name of TF data type
+func dtypeName(dt tf.DataType) string {
+	switch dt {
+	case tf.Float:
+		return "float32"
+	case tf.Double:
+		return "float64"
+	case tf.Half:
+		return "float16"
+	case tf.Bfloat16:
+		return "bfloat16"
+	case tf.Int8:
+		return "int8"
+	case tf.Int16:
+		return "int16"
+	case tf.Int32:
+		return "int32"
+	case tf.Int64:
+		return "int64"
+	case tf.Uint8:
+		return "uint8"
+	case tf.Uint16:
+		return "uint16"
+	case tf.Uint32:
+		return "uint32"
+	case tf.Uint64:
+		return "uint64"
+	case tf.Bool:
+		return "bool"
+	case tf.String:
+		return "string"
+	}
+	return fmt.Sprintf("dtype(%d)", dt)
+}
+
+// helper function to get operation name of tensor name, e.g. op:0
+func tensorOp(name string) string {
+	if idx := strings.LastIndex(name, ":"); idx > 0 {
+		return name[:idx]
+	}
+	return name
+}
+
+// helper function to inspect given graph and SavedModel signatures
+func inspectGraph(graph *tf.Graph, signatures map[string]tf.Signature) GraphInfo {
+	var info GraphInfo
+	ops := graph.Operations()
+	info.NumOperations = len(ops)
+
+	// the graph API provides consumers of operation outputs, therefore we
+	// build operation inputs from consumers of all outputs
+	inputs := make(map[string][]string)
+	terminal := make(map[string]bool)
+	for i := range ops {
+		op := &ops[i]
+		terminal[op.Name()] = op.NumOutputs() > 0
+		for idx := 0; idx < op.NumOutputs(); idx++ {
+			consumers := op.Output(idx).Consumers()
+			if len(consumers) > 0 {
+				terminal[op.Name()] = false
+			}
+			for _, c := range consumers {
+				name := c.Op.Name()
+				inputs[name] = append(inputs[name], fmt.Sprintf("%s:%d", op.Name(), idx))
+			}
+		}
+	}
+	for i := range ops {
+		op := &ops[i]
+		gop := GraphOperation{Name: op.Name(), Type: op.Type(), Inputs: inputs[op.Name()]}
+		for idx := 0; idx < op.NumOutputs(); idx++ {
+			out := op.Output(idx)
+			gop.Outputs = append(gop.Outputs, GraphOutput{Index: idx, DType: dtypeName(out.DataType()), Shape: out.Shape().String()})
+		}
+		info.Operations = append(info.Operations, gop)
+		// string placeholders are used by SavedModel to save and restore variables
+		if (op.Type() == "Placeholder" || op.Type() == "PlaceholderWithDefault") &&
+			op.NumOutputs() > 0 && op.Output(0).DataType() != tf.String {
+			info.InputCandidates = append(info.InputCandidates, op.Name())
+		}
+		if terminal[op.Name()] && !InList(op.Type(), nonOutputTypes) && op.Output(0).DataType() != tf.String {
+			info.OutputCandidates = append(info.OutputCandidates, op.Name())
+		}
+	}
+
+	var keys []string
+	for key := range signatures {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var sigInputs, sigOutputs []string
+	for _, key := range keys {
+		sig := signatures[key]
+		sinfo := SignatureInfo{Key: key, Method: sig.MethodName, Inputs: make(map[string]TensorSpec), Outputs: make(map[string]TensorSpec)}
+		for k, v := range sig.Inputs {
+			sinfo.Inputs[k] = TensorSpec{Name: v.Name, DType: dtypeName(v.DType), Shape: v.Shape.String()}
+			if key == "serving_default" && !InList(tensorOp(v.Name), sigInputs) {
+				sigInputs = append(sigInputs, tensorOp(v.Name))
+			}
+		}
+		for k, v := range sig.Outputs {
+			sinfo.Outputs[k] = TensorSpec{Name: v.Name, DType: dtypeName(v.DType), Shape: v.Shape.String()}
+			if key == "serving_default" && !InList(tensorOp(v.Name), sigOutputs) {
+				sigOutputs = append(sigOutputs, tensorOp(v.Name))
+			}
+		}
+		info.Signatures = append(info.Signatures, sinfo)
+	}
+	// serving signature of SavedModel defines its inputs and outputs
+	if len(sigInputs) > 0 {
+		sort.Strings(sigInputs)
+		info.InputCandidates = sigInputs
+	}
+	if len(sigOutputs) > 0 {
+		sort.Strings(sigOutputs)
+		info.OutputCandidates = sigOutputs
+	}
+	return info
+}
+
+// NodeError represents input or output node of the model which is not
+// declared by model params or does not exist in the model graph
+type NodeError struct {
+	Model      string   // model name
+	Param      string   // model parameter, e.g. input_node or output_name
+	Node       string   // declared node, empty if it is not declared
+	Candidates []string // candidates of the node found in the model graph
+}
+
+// Error implements error interface
+func (e *NodeError) Error() string {
+	msg := fmt.Sprintf("model %s %s %s does not exist in the graph", e.Model, e.Param, e.Node)
+	if e.Node == "" {
+		msg = fmt.Sprintf("model %s params do not provide %s and it can't be inferred", e.Model, e.Param)
+	}
+	if len(e.Candidates) == 0 {
+		return msg + ", the graph does not provide any candidate"
+	}
+	return fmt.Sprintf("%s, available names: %s", msg, strings.Join(e.Candidates, ", "))
+}
+
+// helper function to resolve input or output node of the model in its graph,
+// node which is not declared is either given default node (if it exists in
+// the graph) or single candidate of the graph
+func resolveNode(graph *tf.Graph, model, param, node, fallback string, candidates []string) (string, error) {
+	if node != "" {
+		if graph.Operation(node) != nil {
+			return node, nil
+		}
+		return node, &NodeError{Model: model, Param: param, Node: node, Candidates: candidates}
+	}
+	if fallback != "" && graph.Operation(fallback) != nil {
+		return fallback, nil
+	}
+	if len(candidates) == 1 {
+		return candidates[0], nil
+	}
+	return "", &NodeError{Model: model, Param: param, Candidates: candidates}
+}
+
+// helper function to resolve input and output nodes of the model in its
+// graph, it returns resolved nodes along with nodes inferred from the graph
+func resolveNodes(graph *tf.Graph, signatures map[string]tf.Signature, params TFParams, flavor string) (string, string, ModelMetadata, error) {
+	var inferred ModelMetadata
+	inputParam, outputParam := "input_node", "output_node"
+	input, output := params.InputNode, params.OutputNode
+	var inputDefault, outputDefault string
+	if flavor == "tf2" {
+		inputParam, outputParam = "input_name", "output_name"
+		input, output = params.InputName, params.OutputName
+		inputDefault, outputDefault = DefaultInputName, DefaultOutputName
+	}
+	var info GraphInfo
+	if input == "" || output == "" || graph.Operation(input) == nil || graph.Operation(output) == nil {
+		info = inspectGraph(graph, signatures)
+	}
+	rinput, err := resolveNode(graph, params.Name, inputParam, input, inputDefault, info.InputCandidates)
+	if err != nil {
+		return input, output, inferred, err
+	}
+	routput, err := resolveNode(graph, params.Name, outputParam, output, outputDefault, info.OutputCandidates)
+	if err != nil {
+		return rinput, output, inferred, err
+	}
+	if input == "" && rinput != inputDefault {
+		if flavor == "tf2" {
+			inferred.InputName = rinput
+		} else {
+			inferred.InputNode = rinput
+		}
+	}
+	if output == "" && routput != outputDefault {
+		if flavor == "tf2" {
+			inferred.OutputName = routput
+		} else {
+			inferred.OutputNode = routput
+		}
+	}
+	return rinput, routput, inferred, nil
+}
+
+// helper function to inspect graph of the model from the cache, the model is
+// loaded and verified if it is not in the cache yet
+func inspectModel(name string) (GraphInfo, error) {
+	tfm, release, err := _cache.acquire(name)
+	if err != nil {
+		return GraphInfo{}, err
+	}
+	defer release()
+	var info GraphInfo
+	if tfm.Model != nil {
+		info = inspectGraph(tfm.Model.Graph, tfm.Model.Signatures)
+	} else {
+		info = inspectGraph(tfm.Graph, nil)
+	}
+	info.Model = name
+	info.Flavor = tfm.Flavor
+	return info, nil
+}
+
+// GraphHandler returns introspection of model graph, i.e. its operations,
+// candidates of input and output nodes and SavedModel signatures,
+// summary=true query parameter omits list of operations
+func GraphHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["model"]
+	path := filepath.Join(_config.ModelDir, name)
+	_, flavor, err := checkModelArea(path, name)
+	if err != nil {
+		msg := fmt.Sprintf("unable to read model %s", name)
+		responseError(w, msg, err, http.StatusNotFound)
+		return
+	}
+	if flavor == "pipeline" {
+		msg := fmt.Sprintf("model %s is a pipeline and does not have a graph", name)
+		responseError(w, msg, nil, http.StatusBadRequest)
+		return
+	}
+	info, err := inspectModel(name)
+	if err != nil {
+		// models with unknown nodes can't be loaded, we report available names
+		responsePredictionError(w, fmt.Sprintf("unable to inspect model %s", name), err)
+		return
+	}
+	if v := r.URL.Query().Get("summary"); v == "1" || v == "true" {
+		info.Operations = nil
+	}
+	responseJSON(w, info)
+}
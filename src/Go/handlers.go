@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -12,6 +13,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"time"
@@ -42,6 +44,22 @@ func responseError(w http.ResponseWriter, msg string, err error, code int) {
 	json.NewEncoder(w).Encode(map[string]string{"error": msg})
 }
 
+// helper function to provide response for prediction errors, models with
+// missing or unknown input/output nodes are reported as bad requests along
+// with names available in the model graph, requests which exceeded their
+// deadline get gateway timeout along with their timing
+func responsePredictionError(w http.ResponseWriter, msg string, err error) {
+	if responseDeadlineError(w, msg, err) {
+		return
+	}
+	var nerr *NodeError
+	if errors.As(err, &nerr) {
+		responseError(w, fmt.Sprintf("%s: %v", msg, nerr), err, http.StatusBadRequest)
+		return
+	}
+	responseError(w, msg, err, http.StatusInternalServerError)
+}
+
 // helper function to provide response in JSON data format
 func responseJSON(w http.ResponseWriter, data interface{}) {
 	w.WriteHeader(http.StatusOK)
@@ -88,6 +106,15 @@ func ImageHandler(w http.ResponseWriter, r *http.Request) {
 		responseError(w, msg, nil, http.StatusInternalServerError)
 		return
 	}
+	if !allowModel(w, r, model) {
+		return
+	}
+	inf, ok := admit(w, r, model)
+	if !ok {
+		return
+	}
+	defer inf.close()
+	r = withInference(r, inf)
 	tfModel, err := tfVersion(model)
 	if err != nil {
 		msg := fmt.Sprintf("unable to read %s model", model)
@@ -147,9 +174,14 @@ func ImageTF2Handler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Run inference
-	probs, err := makePredictionsTensor(model, tensor)
+	var probs []float32
+	err = requestInference(r).run(func(ctx context.Context) error {
+		var err error
+		probs, err = makePredictionsTensor(model, tensor)
+		return err
+	})
 	if err != nil {
-		responseError(w, "unable to make predictions", err, http.StatusInternalServerError)
+		responsePredictionError(w, "unable to make predictions", err)
 		return
 	}
 
@@ -167,12 +199,6 @@ func ImageTF1Handler(w http.ResponseWriter, r *http.Request) {
 		responseError(w, msg, nil, http.StatusInternalServerError)
 		return
 	}
-	// read image model
-	tfm, err := _cache.get(model)
-	if err != nil {
-		responseError(w, "unable to get image model from the cache", err, http.StatusInternalServerError)
-		return
-	}
 
 	// Read image
 	imageFile, header, err := r.FormFile("image")
@@ -208,12 +234,48 @@ func ImageTF1Handler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Run inference
-	session, err := tf.NewSession(tfm.Graph, _sessionOptions)
+	// Run inference, the model and its session are used until inference is
+	// finished even if request deadline is exceeded
+	var probs []float32
+	var labels []string
+	err = requestInference(r).run(func(ctx context.Context) error {
+		var err error
+		probs, labels, err = classifyImage(model, tensor)
+		return err
+	})
 	if err != nil {
-		responseError(w, "Unable to create new session", err, http.StatusInternalServerError)
+		responsePredictionError(w, "Could not run inference", err)
 		return
 	}
+
+	// make prediction response
+	topN := 5
+	if len(labels) < topN {
+		topN = len(labels)
+	}
+	responseJSON(w, ClassifyResult{
+		Filename: fileName,
+		Labels:   findBestLabels(labels, probs, topN),
+	})
+}
+
+// helper function to classify image tensor with TF 1.X image model, it
+// returns model probabilities along with model labels
+func classifyImage(model string, tensor *tf.Tensor) ([]float32, []string, error) {
+	// read image model
+	tfm, release, err := _cache.acquire(model)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to get image model from the cache: %w", err)
+	}
+	defer release()
+	inputNode, outputNode, err := tfm.nodes()
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to get image model nodes: %w", err)
+	}
+	session, err := tf.NewSession(tfm.Graph, _sessionOptions)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to create new session: %w", err)
+	}
 	defer session.Close()
 	if VERBOSE > 0 {
 		devices, err := session.ListDevices()
@@ -225,28 +287,18 @@ func ImageTF1Handler(w http.ResponseWriter, r *http.Request) {
 	}
 	output, err := session.Run(
 		map[tf.Output]*tf.Tensor{
-			tfm.Graph.Operation(tfm.Params.InputNode).Output(0): tensor,
+			inputNode: tensor,
 		},
 		[]tf.Output{
-			tfm.Graph.Operation(tfm.Params.OutputNode).Output(0),
+			outputNode,
 		},
 		nil)
 	if err != nil {
-		responseError(w, "Could not run inference", err, http.StatusInternalServerError)
-		return
+		return nil, nil, err
 	}
 	// our model probabilities
 	probs := output[0].Value().([][]float32)[0]
-
-	// make prediction response
-	topN := 5
-	if len(tfm.Labels) < topN {
-		topN = len(tfm.Labels)
-	}
-	responseJSON(w, ClassifyResult{
-		Filename: fileName,
-		Labels:   findBestLabels(tfm.Labels, probs, topN),
-	})
+	return probs, tfm.Labels, nil
 }
 
 // PredictProtobufHandler send prediction from TF ML model
@@ -277,11 +329,24 @@ func PredictProtobufHandler(w http.ResponseWriter, r *http.Request) {
 		values = append(values, v)
 	}
 	records := &Row{Keys: keys, Values: values, Model: recs.Model}
+	if !allowModel(w, r, records.Model) {
+		return
+	}
+	inf, ok := admit(w, r, predictionModels(records.Model)...)
+	if !ok {
+		return
+	}
+	defer inf.close()
 
 	// generate predictions
-	probs, err := makePredictions(records)
+	var probs []float32
+	err = inf.run(func(ctx context.Context) error {
+		var err error
+		probs, err = makePredictions(ctx, records)
+		return err
+	})
 	if err != nil {
-		responseError(w, "unable to make predictions", err, http.StatusInternalServerError)
+		responsePredictionError(w, "unable to make predictions", err)
 		return
 	}
 
@@ -322,10 +387,40 @@ func PredictHandler(w http.ResponseWriter, r *http.Request) {
 		log.Println("received", recs)
 	}
 
+	if !allowModel(w, r, recs.Model) {
+		return
+	}
+	inf, ok := admit(w, r, predictionModels(recs.Model)...)
+	if !ok {
+		return
+	}
+	defer inf.close()
+
+	// pipelines provide their predictions along with per-stage metadata
+	if recs.Model != "" && isPipeline(recs.Model) {
+		var res PipelineResult
+		err := inf.run(func(ctx context.Context) error {
+			var err error
+			res, err = makePipelinePredictions(ctx, recs.Model, recs)
+			return err
+		})
+		if err != nil {
+			responsePredictionError(w, "PredictHandler: unable to run pipeline", err)
+			return
+		}
+		responseJSON(w, res)
+		return
+	}
+
 	// generate predictions
-	probs, err := makePredictions(recs)
+	var probs []float32
+	err = inf.run(func(ctx context.Context) error {
+		var err error
+		probs, err = makePredictions(ctx, recs)
+		return err
+	})
 	if err != nil {
-		responseError(w, "PredictHandler: unable to make predictions", err, http.StatusInternalServerError)
+		responsePredictionError(w, "PredictHandler: unable to make predictions", err)
 		return
 	}
 	responseJSON(w, probs)
@@ -370,44 +465,81 @@ func UploadHandler(w http.ResponseWriter, r *http.Request) {
 
 // UploadBundleHandler uploads TF models into the server
 func UploadBundleHandler(w http.ResponseWriter, r *http.Request) {
-	var err error
-	var bundle []byte
 	defer r.Body.Close()
+	var reader io.Reader = http.MaxBytesReader(w, r.Body, maxBundleSize())
 	if r.Header.Get("Content-Encoding") == "gzip" {
 		r.Header.Del("Content-Length")
-		reader, err := gzip.NewReader(r.Body)
+		gz, err := gzip.NewReader(reader)
 		if err != nil {
 			msg := "unable to get gzip reader"
-			responseError(w, msg, err, http.StatusInternalServerError)
+			responseError(w, msg, err, http.StatusBadRequest)
 			return
 		}
-		bundle, err = ioutil.ReadAll(GzipReader{reader, r.Body})
-	} else {
-		bundle, err = ioutil.ReadAll(r.Body)
+		defer gz.Close()
+		reader = gz
 	}
+	bundle, err := newBundle()
 	if err != nil {
-		msg := "unable to read body"
-		responseError(w, msg, err, http.StatusInternalServerError)
+		responseError(w, "unable to create staging area", err, http.StatusInternalServerError)
 		return
 	}
-	//     fname := fmt.Sprintf("/tmp/bundle.tar")
-	fname := fmt.Sprintf("%s/bundle.tar", os.TempDir())
-	defer os.Remove(fname)
-	err = ioutil.WriteFile(fname, bundle, 0600)
-	if err != nil {
-		msg := fmt.Sprintf("unable to write %s", fname)
-		responseError(w, msg, err, http.StatusInternalServerError)
+	defer bundle.Cleanup()
+	if err := bundle.Unpack(reader); err != nil {
+		bundleError(w, "unable to unpack bundle", err)
 		return
 	}
-	err = Untar(fname, _config.ModelDir)
-	if err != nil {
-		msg := fmt.Sprintf("unable to untar %s", fname)
-		responseError(w, msg, err, http.StatusInternalServerError)
+	deployBundle(w, r, bundle)
+}
+
+// helper function to validate unpacked bundle and activate it unless
+// request asks for validation only
+func deployBundle(w http.ResponseWriter, r *http.Request, bundle *Bundle) {
+	report := bundle.Report()
+	if dryRun(r) {
+		responseJSON(w, report)
+		return
+	}
+	if !report.Valid {
+		responseReport(w, report)
+		return
+	}
+	if err := bundle.authorize(requestIdentity(r)); err != nil {
+		responseError(w, fmt.Sprintf("unable to activate bundle: %v", err), err, http.StatusForbidden)
+		return
+	}
+	if err := bundle.Activate(); err != nil {
+		responseError(w, "unable to activate bundle", err, http.StatusInternalServerError)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
 }
 
+// helper function to provide validation report of invalid bundle
+func responseReport(w http.ResponseWriter, report ValidationReport) {
+	log.Println("ERROR invalid bundle", report.Error)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(report)
+}
+
+// ValidateHandler validates uploaded bundle without touching model directory
+func ValidateHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	q.Set("dryrun", "true")
+	r.URL.RawQuery = q.Encode()
+	UploadHandler(w, r)
+}
+
+// helper function to report bundle errors
+func bundleError(w http.ResponseWriter, msg string, err error) {
+	var maxErr *http.MaxBytesError
+	if errors.Is(err, ErrBundleTooLarge) || errors.As(err, &maxErr) {
+		responseError(w, fmt.Sprintf("%s: %v", msg, ErrBundleTooLarge), err, http.StatusRequestEntityTooLarge)
+		return
+	}
+	responseError(w, fmt.Sprintf("%s: %v", msg, err), err, http.StatusBadRequest)
+}
+
 // UploadFormHandler uploads TF models into the server via form key-value pairs
 func UploadFormHandler(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
@@ -418,17 +550,37 @@ func UploadFormHandler(w http.ResponseWriter, r *http.Request) {
 	ctype := r.Header.Get("Content-Encoding")
 	var mkey, path string
 	var params TFParams
+	// form files larger than 32MB are stored in temporary files by multipart
+	// reader rather than in memory
+	r.Body = http.MaxBytesReader(w, r.Body, maxBundleSize())
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		bundleError(w, "unable to parse upload form", err)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+	bundle, err := newBundle()
+	if err != nil {
+		responseError(w, "unable to create staging area", err, http.StatusInternalServerError)
+		return
+	}
+	defer bundle.Cleanup()
 	for _, name := range []string{"name", "params", "model", "labels", "op"} {
 		emsg := fmt.Sprintf("request does not provide %s", name)
 		if name == "name" {
 			mkey = r.FormValue(name)
 			if mkey == "" {
-				responseError(w, emsg, nil, http.StatusInternalServerError)
+				responseError(w, emsg, nil, http.StatusBadRequest)
 				return
 			}
-			path = fmt.Sprintf("%s/%s", _config.ModelDir, mkey)
+			if !validModelName(mkey) {
+				msg := fmt.Sprintf("invalid model name %s", mkey)
+				responseError(w, msg, nil, http.StatusBadRequest)
+				return
+			}
+			bundle.Models = []string{mkey}
+			path = filepath.Join(bundle.Root, mkey)
 			// create requested area for TF model
-			err := os.MkdirAll(path, 0744)
+			err := os.MkdirAll(path, 0755)
 			if err != nil {
 				msg := fmt.Sprintf("unable to create %s", path)
 				responseError(w, msg, err, http.StatusInternalServerError)
@@ -439,33 +591,52 @@ func UploadFormHandler(w http.ResponseWriter, r *http.Request) {
 		// read other parameters which represent files
 		modelFile, header, err := r.FormFile(name)
 		if err != nil {
-			responseError(w, emsg, err, http.StatusInternalServerError)
+			responseError(w, emsg, err, http.StatusBadRequest)
 			return
 		}
-		defer modelFile.Close()
 
 		// prepare file name to write to
-		arr := strings.Split(header.Filename, "/")
-		fname := arr[len(arr)-1]
+		fname := filepath.Base(header.Filename)
 		if name == "params" && fname != "params.json" {
 			fname = "params.json"
 			msg := fmt.Sprintf("store as %s", fname)
 			log.Println("file", header.Filename, msg)
 		}
-		fileName := fmt.Sprintf("%s/%s", path, fname)
+		if !validFileName(fname) || InList(fname, serverFiles) {
+			modelFile.Close()
+			msg := fmt.Sprintf("invalid file name %s", header.Filename)
+			responseError(w, msg, nil, http.StatusBadRequest)
+			return
+		}
+		fileName := filepath.Join(path, fname)
 
-		// read data from request and write it out to our local file
-		data, err := ioutil.ReadAll(modelFile)
+		// copy data from request to our local file
+		var reader io.Reader = modelFile
+		if ctype == "base64" && name == "model" {
+			reader = base64.NewDecoder(base64.StdEncoding, modelFile)
+		}
+		err = copyFile(fileName, reader)
+		modelFile.Close()
 		if err != nil {
-			responseError(w, "unable to read model file", err, http.StatusInternalServerError)
+			var b64Err base64.CorruptInputError
+			if errors.As(err, &b64Err) {
+				responseError(w, "unable to decode input data", err, http.StatusBadRequest)
+				return
+			}
+			responseError(w, "unable to write file", err, http.StatusInternalServerError)
 			return
 		}
 
 		// read TF parameters
 		if name == "params" {
+			data, err := ioutil.ReadFile(fileName)
+			if err != nil {
+				responseError(w, "unable to read TF parameters", err, http.StatusInternalServerError)
+				return
+			}
 			err = json.Unmarshal(data, &params)
 			if err != nil {
-				responseError(w, "unable to unmarshal TF parameters", err, http.StatusInternalServerError)
+				responseError(w, "unable to unmarshal TF parameters", err, http.StatusBadRequest)
 				return
 			}
 			if params.TimeStamp == "" {
@@ -473,35 +644,30 @@ func UploadFormHandler(w http.ResponseWriter, r *http.Request) {
 			}
 			if mkey != params.Name {
 				msg := fmt.Sprintf("mismatch of mkey=%s and TFParam.Name=%s", mkey, params.Name)
-				responseError(w, msg, err, http.StatusInternalServerError)
+				responseError(w, msg, err, http.StatusBadRequest)
 				return
 			}
 			log.Println("TF model parameters", params.String())
 		}
-
-		if ctype == "base64" && name == "model" {
-			var newData []byte
-			newData, err = base64.StdEncoding.DecodeString(string(data))
-			if err != nil {
-				responseError(w, "unable to decode input data", err, http.StatusInternalServerError)
-				return
-			}
-			err = ioutil.WriteFile(fileName, newData, 0644)
-			if err != nil {
-				responseError(w, "unable to write file", err, http.StatusInternalServerError)
-				return
-			}
-
-		} else {
-			// write out content to our store
-			err = ioutil.WriteFile(fileName, data, 0644)
-			if err != nil {
-				responseError(w, "unable to write file", err, http.StatusInternalServerError)
-				return
-			}
-		}
 		log.Println("Uploaded", fileName)
 	}
+	report := bundle.Report()
+	if dryRun(r) {
+		responseJSON(w, report)
+		return
+	}
+	if !report.Valid {
+		responseReport(w, report)
+		return
+	}
+	if err := bundle.authorize(requestIdentity(r)); err != nil {
+		responseError(w, fmt.Sprintf("unable to activate model: %v", err), err, http.StatusForbidden)
+		return
+	}
+	if err := bundle.Activate(); err != nil {
+		responseError(w, "unable to activate model", err, http.StatusInternalServerError)
+		return
+	}
 	// set current parameters set
 	_params = params
 	w.WriteHeader(http.StatusOK)
@@ -513,19 +679,14 @@ func ParamsHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
 		vars := mux.Vars(r)
 		model := vars["model"]
-		fname := fmt.Sprintf("%s/%s/params.json", _config.ModelDir, model)
-		if _, err := os.Stat(fname); err != nil {
-			msg := "unable to read params.json model file"
-			responseError(w, msg, err, http.StatusInternalServerError)
-			return
-		}
-		data, err := ioutil.ReadFile(fname)
+		params, err := readParams(model)
 		if err != nil {
-			msg := fmt.Sprintf("unable to read %s model file", fname)
+			msg := "unable to read params.json model file"
 			responseError(w, msg, err, http.StatusInternalServerError)
 			return
 		}
-		w.Write(data)
+		params.Checksums = modelChecksums(model)
+		responseJSON(w, params)
 		return
 	}
 	defer r.Body.Close()
@@ -548,14 +709,87 @@ func ParamsHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-// ModelsHandler returns a list of known models
+// PipelineHandler uploads or returns pipeline definitions
+func PipelineHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		vars := mux.Vars(r)
+		p, err := getPipeline(vars["model"])
+		if err != nil {
+			msg := fmt.Sprintf("unable to read %s pipeline", vars["model"])
+			responseError(w, msg, err, http.StatusNotFound)
+			return
+		}
+		responseJSON(w, p)
+		return
+	}
+	defer r.Body.Close()
+	var p Pipeline
+	err := json.NewDecoder(r.Body).Decode(&p)
+	if err != nil {
+		responseError(w, "unable to decode pipeline", err, http.StatusBadRequest)
+		return
+	}
+	// validate pipeline DAG before we store it
+	if _, err := p.Validate(); err != nil {
+		responseError(w, fmt.Sprintf("invalid pipeline: %v", err), err, http.StatusBadRequest)
+		return
+	}
+	id := requestIdentity(r)
+	if err := authorizeModel(id, p.Name); err != nil {
+		responseError(w, fmt.Sprintf("unable to store pipeline: %v", err), err, http.StatusForbidden)
+		return
+	}
+	group, err := ownerGroup(id, p.Name, "")
+	if err != nil {
+		responseError(w, fmt.Sprintf("unable to store pipeline: %v", err), err, http.StatusForbidden)
+		return
+	}
+	if flavor, err := tfVersion(p.Name); err == nil && flavor != "pipeline" {
+		msg := fmt.Sprintf("model %s already exists and it is not a pipeline", p.Name)
+		responseError(w, msg, nil, http.StatusConflict)
+		return
+	}
+	if err := storePipeline(p, group); err != nil {
+		responseError(w, "unable to store pipeline", err, http.StatusInternalServerError)
+		return
+	}
+	log.Println("Uploaded pipeline", p.Name)
+	w.WriteHeader(http.StatusOK)
+}
+
+// EvaluationHandler returns evaluation report of the model on its test dataset
+func EvaluationHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	model := vars["model"]
+	eval, err := readEvaluation(model)
+	if err != nil {
+		msg := fmt.Sprintf("unable to read evaluation report of %s model", model)
+		code := http.StatusInternalServerError
+		if os.IsNotExist(err) {
+			code = http.StatusNotFound
+		}
+		responseError(w, msg, err, code)
+		return
+	}
+	responseJSON(w, eval)
+}
+
+// ModelsHandler returns a list of known models, it supports filtering,
+// sorting and pagination, e.g. /models?tag=cms&q=btag&sort=-uploaded&limit=10
 func ModelsHandler(w http.ResponseWriter, r *http.Request) {
+	query, err := parseModelQuery(r.URL.Query())
+	if err != nil {
+		responseError(w, fmt.Sprintf("invalid query: %v", err), err, http.StatusBadRequest)
+		return
+	}
 	models, err := TFModels()
 	if err != nil {
 		msg := fmt.Sprintf("Unable to get TF models")
 		responseError(w, msg, err, http.StatusInternalServerError)
 		return
 	}
+	models, total := query.Apply(models)
+	w.Header().Set("X-Total-Count", fmt.Sprintf("%d", total))
 	responseJSON(w, models)
 }
 
@@ -568,9 +802,14 @@ func DefaultHandler(w http.ResponseWriter, r *http.Request) {
 	tmplData["Version"] = info()
 	tmplData["Models"], _ = TFModels()
 	tmplData["ModelDir"] = _config.ModelDir
+	if id := requestIdentity(r); id.HasRole(RoleAdmin) {
+		tmplData["Admin"] = true
+		tmplData["Cache"] = _cache.records()
+	}
 	main := templates.Main(_tmplDir, tmplData)
+	header, footer := pageTemplates()
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(_header + main + _footer))
+	w.Write([]byte(header + main + footer))
 }
 
 // StatusHandler handlers Status requests
@@ -591,6 +830,9 @@ func StatusHandler(w http.ResponseWriter, r *http.Request) {
 	tmplData["Uptime"] = time.Since(Time0).Seconds()
 	tmplData["getRequests"] = TotalGetRequests
 	tmplData["postRequests"] = TotalPostRequests
+	tmplData["Models"] = _cache.records()
+	tmplData["Queues"] = _queues.stats()
+	tmplData["Draining"] = draining()
 	data, err := json.Marshal(tmplData)
 	if err != nil {
 		msg := "unable to marshal data"
@@ -665,6 +907,14 @@ func DeleteHandler(w http.ResponseWriter, r *http.Request) {
 		responseError(w, "no model name is provided", nil, http.StatusBadRequest)
 		return
 	}
+	if !validModelName(model) {
+		responseError(w, fmt.Sprintf("invalid model name %s", model), nil, http.StatusBadRequest)
+		return
+	}
+	if err := authorizeModel(requestIdentity(r), model); err != nil {
+		responseError(w, fmt.Sprintf("unable to delete model: %v", err), err, http.StatusForbidden)
+		return
+	}
 	files, err := ioutil.ReadDir(_config.ModelDir)
 	if err != nil {
 		responseError(w, fmt.Sprintf("unable to read: %s", _config.ModelDir), err, http.StatusInternalServerError)
@@ -681,5 +931,6 @@ func DeleteHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	_cache.remove(model)
+	refreshModels()
 	w.WriteHeader(http.StatusOK)
 }
@@ -0,0 +1,224 @@
+package main
+
+// health module provides liveness and readiness probes of the server and
+// readiness of individual models
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// checks of readiness probe
+const (
+	CheckModelDir  = "modelDir"  // model directory is readable
+	CheckModels    = "models"    // required and preloaded models are loaded and warmed up
+	CheckInference = "inference" // required and preloaded models pass test inference
+)
+
+// default checks of readiness probe
+var defaultReadyChecks = []string{CheckModelDir, CheckModels}
+
+// preloaded flag is set once models are preloaded at startup
+var _preloaded int32
+
+// CheckResult represents result of readiness check
+type CheckResult struct {
+	Name  string `json:"name"`            // check name
+	OK    bool   `json:"ok"`              // check status
+	Error string `json:"error,omitempty"` // reason of failed check
+}
+
+// helper function to write JSON response with given status code
+func responseStatus(w http.ResponseWriter, data interface{}, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(data)
+}
+
+// helper function to get models which should be loaded before server is
+// ready, i.e. required models from server configuration and preloaded
+// models, pipelines are expanded to models of their stages
+func readyModels() ([]string, error) {
+	names := append([]string{}, _config.ReadyModels...)
+	names = append(names, _config.Preload...)
+	models, err := TFModels()
+	if err != nil {
+		return nil, err
+	}
+	for _, params := range models {
+		if params.Preload {
+			names = append(names, params.Name)
+		}
+	}
+	var out []string
+	for _, name := range names {
+		for _, model := range predictionModels(name) {
+			if !InList(model, out) {
+				out = append(out, model)
+			}
+		}
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// helper function to get sample input of the model, the first warm-up sample
+// is used if model has one, otherwise zero vector of model input size
+func sampleInput(tfm *TFModel) ([]float32, error) {
+	path := fmt.Sprintf("%s/%s", _config.ModelDir, tfm.Params.Name)
+	rows, err := warmupSamples(path, tfm.Params)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) > 0 {
+		return rows[0].Values, nil
+	}
+	input, _, err := tfm.nodes()
+	if err != nil {
+		return nil, err
+	}
+	shape := input.Shape()
+	if shape.NumDimensions() != 2 || shape.Size(1) <= 0 {
+		return nil, fmt.Errorf("model %s has no warm-up samples and its input shape %v is not a vector", tfm.Params.Name, shape)
+	}
+	return make([]float32, shape.Size(1)), nil
+}
+
+// helper function to make test inference of loaded model, models are not
+// loaded by the probe since it may take long and evict other models
+func testInference(name string) error {
+	if !_cache.loaded(name) {
+		return fmt.Errorf("model %s is not loaded", name)
+	}
+	tfm, release, err := _cache.acquire(name)
+	if err != nil {
+		return err
+	}
+	defer release()
+	values, err := sampleInput(&tfm)
+	if err != nil {
+		return err
+	}
+	if _, err := tfm.predict(values); err != nil {
+		return fmt.Errorf("test inference of %s failed: %v", name, err)
+	}
+	return nil
+}
+
+// helper function to perform given check of readiness probe
+func readyCheck(name string) error {
+	switch name {
+	case CheckModelDir:
+		_, err := ioutil.ReadDir(_config.ModelDir)
+		return err
+	case CheckModels, CheckInference:
+		if atomic.LoadInt32(&_preloaded) == 0 {
+			return fmt.Errorf("models are being preloaded")
+		}
+		models, err := readyModels()
+		if err != nil {
+			return err
+		}
+		for _, model := range models {
+			if name == CheckInference {
+				err = testInference(model)
+			} else if !_cache.loaded(model) {
+				err = fmt.Errorf("model %s is not loaded", model)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown check %s", name)
+}
+
+// HealthzHandler reports that server process is alive
+func HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	responseJSON(w, map[string]interface{}{
+		"status": "ok",
+		"uptime": time.Since(Time0).Seconds(),
+	})
+}
+
+// ReadyzHandler reports if server is ready to serve requests, it returns
+// 503 if server is draining or any of configured checks fails
+func ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	ready := !draining()
+	results := []CheckResult{{Name: "draining", OK: ready}}
+	if !ready {
+		results[0].Error = "server is shutting down"
+	}
+	checks := _config.ReadyChecks
+	if len(checks) == 0 {
+		checks = defaultReadyChecks
+	}
+	for _, name := range checks {
+		res := CheckResult{Name: name, OK: true}
+		if err := readyCheck(name); err != nil {
+			res.OK = false
+			res.Error = err.Error()
+			ready = false
+		}
+		results = append(results, res)
+	}
+	code := http.StatusOK
+	if !ready {
+		code = http.StatusServiceUnavailable
+	}
+	responseStatus(w, map[string]interface{}{"ready": ready, "checks": results}, code)
+}
+
+// ModelReadyHandler performs test inference of the model, or of models of
+// pipeline stages, and reports if the model is ready to serve predictions,
+// unknown models are reported as not found rather than not ready
+func ModelReadyHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["model"]
+	if _, err := tfVersion(name); err != nil {
+		responseError(w, fmt.Sprintf("unknown model %s", name), err, http.StatusNotFound)
+		return
+	}
+	if draining() {
+		responseStatus(w, map[string]interface{}{"model": name, "ready": false, "error": "server is shutting down"}, http.StatusServiceUnavailable)
+		return
+	}
+	models := predictionModels(name)
+	inf, ok := admit(w, r, models...)
+	if !ok {
+		return
+	}
+	defer inf.close()
+	time0 := time.Now()
+	err := inf.run(func(ctx context.Context) error {
+		for _, model := range models {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := testInference(model); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		if responseDeadlineError(w, fmt.Sprintf("model %s is not ready", name), err) {
+			return
+		}
+		responseStatus(w, map[string]interface{}{"model": name, "ready": false, "error": err.Error()}, http.StatusServiceUnavailable)
+		return
+	}
+	responseJSON(w, map[string]interface{}{
+		"model":     name,
+		"ready":     true,
+		"inference": time.Since(time0).Seconds(),
+	})
+}
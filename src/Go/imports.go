@@ -0,0 +1,398 @@
+package main
+
+// imports module provides asynchronous import of model bundles from URLs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// import job states
+const (
+	ImportPending = "pending"
+	ImportRunning = "running"
+	ImportDone    = "done"
+	ImportFailed  = "failed"
+)
+
+// keep finished import jobs for given period of time
+const importJobTTL = time.Hour
+
+// ErrTooManyImports is returned when import jobs reach their limit
+var ErrTooManyImports = errors.New("too many import jobs")
+
+// ImportRequest represents request to import bundle from given URL
+type ImportRequest struct {
+	URL      string `json:"url"`      // file:// or http(s):// URL of the bundle
+	Checksum string `json:"checksum"` // expected SHA-256 of the bundle, optional
+	DryRun   bool   `json:"dryrun"`   // only validate the bundle
+}
+
+// ImportJob represents asynchronous import of the bundle
+type ImportJob struct {
+	ID       string            `json:"id"`               // job identifier
+	URL      string            `json:"url"`              // bundle URL
+	Checksum string            `json:"checksum"`         // SHA-256 of the bundle
+	DryRun   bool              `json:"dryrun"`           // only validate the bundle
+	Status   string            `json:"status"`           // job status
+	Bytes    int64             `json:"bytes"`            // number of fetched bytes
+	Size     int64             `json:"size"`             // bundle size if known
+	Error    string            `json:"error,omitempty"`  // job error
+	Report   *ValidationReport `json:"report,omitempty"` // validation report of the bundle
+	Created  time.Time         `json:"created"`          // job creation time
+	Updated  time.Time         `json:"updated"`          // last update of job status
+	Owner    string            `json:"owner"`            // client who started the job
+	identity Identity          // identity of the client used to authorize activation
+	read     *int64            // number of fetched bytes updated while job is running
+}
+
+// ImportJobs keeps track of import jobs
+type ImportJobs struct {
+	Jobs map[string]*ImportJob
+	mu   sync.RWMutex
+}
+
+// global import jobs
+var _imports = ImportJobs{Jobs: make(map[string]*ImportJob)}
+
+// helper function to add new import job, finished jobs are kept for some time
+// such that clients can poll their status while number of unfinished jobs is
+// limited by server configuration
+func (j *ImportJobs) add(req ImportRequest, client Identity) (*ImportJob, error) {
+	now := time.Now()
+	job := &ImportJob{
+		ID:       randomID(),
+		URL:      req.URL,
+		Checksum: strings.ToLower(req.Checksum),
+		DryRun:   req.DryRun,
+		Status:   ImportPending,
+		Created:  now,
+		Updated:  now,
+		Owner:    client.Name,
+		identity: client,
+		read:     new(int64),
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	active := 0
+	for id, job := range j.Jobs {
+		finished := job.Status == ImportDone || job.Status == ImportFailed
+		if finished && time.Since(job.Updated) > importJobTTL {
+			delete(j.Jobs, id)
+		} else if !finished {
+			active++
+		}
+	}
+	if active >= _config.MaxImports {
+		return nil, ErrTooManyImports
+	}
+	j.Jobs[job.ID] = job
+	return job, nil
+}
+
+// helper function to get snapshot of import job
+func (j *ImportJobs) get(id string) (ImportJob, bool) {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	job, ok := j.Jobs[id]
+	if !ok {
+		return ImportJob{}, false
+	}
+	snapshot := *job
+	snapshot.Bytes = atomic.LoadInt64(job.read)
+	return snapshot, true
+}
+
+// helper function to check if import job is visible to given client, i.e.
+// clients see their own jobs while admins see all jobs
+func (job *ImportJob) visible(client Identity) bool {
+	if client.HasRole(RoleAdmin) {
+		return true
+	}
+	return job.identity.Method == client.Method && job.identity.Name == client.Name
+}
+
+// helper function to get snapshots of import jobs visible to given client
+func (j *ImportJobs) list(client Identity) []ImportJob {
+	j.mu.RLock()
+	var ids []string
+	for id := range j.Jobs {
+		ids = append(ids, id)
+	}
+	j.mu.RUnlock()
+	var jobs []ImportJob
+	for _, id := range ids {
+		if job, ok := j.get(id); ok && job.visible(client) {
+			jobs = append(jobs, job)
+		}
+	}
+	sort.Slice(jobs, func(i, k int) bool { return jobs[i].Created.Before(jobs[k].Created) })
+	return jobs
+}
+
+// helper function to update import job
+func (j *ImportJobs) update(job *ImportJob, fn func(job *ImportJob)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	fn(job)
+	job.Updated = time.Now()
+}
+
+// helper function to get URL which can be shown to clients and logged, i.e.
+// without password and query which may carry access tokens of signed URLs
+func redactedURL(u *url.URL) string {
+	r := *u
+	r.RawQuery = ""
+	r.Fragment = ""
+	return r.Redacted()
+}
+
+// helper function to check that URL can be used to import bundles, remote
+// hosts should be listed in import hosts (if they are configured) and local
+// files should be placed in one of configured import areas
+func checkImportURL(rurl string) (*url.URL, error) {
+	u, err := url.Parse(rurl)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https":
+		if len(_config.ImportHosts) > 0 && !InList(u.Hostname(), _config.ImportHosts) {
+			return nil, fmt.Errorf("host %s is not allowed", u.Hostname())
+		}
+		return u, nil
+	case "file":
+		path := filepath.Clean(u.Path)
+		for _, dir := range _config.ImportDirs {
+			if rel, err := filepath.Rel(filepath.Clean(dir), path); err == nil && filepath.IsLocal(rel) {
+				return u, nil
+			}
+		}
+		return nil, fmt.Errorf("file %s is outside of import areas", path)
+	}
+	return nil, fmt.Errorf("unsupported URL scheme '%s'", u.Scheme)
+}
+
+// helper function to check that remote address can be used to import
+// bundles, unless import hosts are configured we do not allow the server to
+// fetch bundles from its own network, e.g. loopback, private addresses or
+// metadata services of cloud providers
+func allowedImportIP(ip net.IP) bool {
+	if len(_config.ImportHosts) > 0 {
+		return true
+	}
+	return ip != nil && !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsUnspecified() &&
+		!ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() && !ip.IsInterfaceLocalMulticast()
+}
+
+// helper function to get HTTP client used to fetch bundles, its timeout
+// covers complete download such that import jobs of stalled remotes fail,
+// addresses are checked when connection is made such that host names and
+// redirects can't point to internal addresses
+func importClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 30 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if !allowedImportIP(net.ParseIP(host)) {
+				return fmt.Errorf("address %s is not allowed", host)
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Timeout:   seconds(_config.ImportTimeout),
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("too many redirects")
+			}
+			_, err := checkImportURL(req.URL.String())
+			return err
+		},
+	}
+}
+
+// helper function to open bundle at given URL, it returns bundle reader and
+// bundle size if it is known
+func openBundleURL(u *url.URL) (io.ReadCloser, int64, error) {
+	if u.Scheme == "file" {
+		file, err := os.Open(filepath.Clean(u.Path))
+		if err != nil {
+			return nil, 0, err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, 0, err
+		}
+		if !info.Mode().IsRegular() {
+			file.Close()
+			return nil, 0, fmt.Errorf("%s is not a regular file", u.Path)
+		}
+		return file, info.Size(), nil
+	}
+	resp, err := importClient().Get(u.String())
+	if err != nil {
+		// do not expose URL of the bundle
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+		return nil, 0, fmt.Errorf("unable to fetch %s: %v", redactedURL(u), err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, 0, fmt.Errorf("unable to fetch %s, status %s", redactedURL(u), resp.Status)
+	}
+	return resp.Body, resp.ContentLength, nil
+}
+
+// progressReader counts number of read bytes
+type progressReader struct {
+	R     io.Reader
+	Bytes *int64
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.R.Read(b)
+	atomic.AddInt64(p.Bytes, int64(n))
+	return n, err
+}
+
+// helper function to run import job, i.e. fetch, verify, unpack, validate
+// and activate the bundle
+func runImport(job *ImportJob, u *url.URL) {
+	_imports.update(job, func(job *ImportJob) { job.Status = ImportRunning })
+	report, err := importBundle(job, u)
+	_imports.update(job, func(job *ImportJob) {
+		job.Report = report
+		if err != nil {
+			job.Status = ImportFailed
+			job.Error = err.Error()
+			log.Printf("import %s from %s failed: %v", job.ID, redactedURL(u), err)
+			return
+		}
+		job.Status = ImportDone
+		log.Printf("import %s from %s is done", job.ID, redactedURL(u))
+	})
+}
+
+// helper function to import bundle of the import job
+func importBundle(job *ImportJob, u *url.URL) (*ValidationReport, error) {
+	reader, size, err := openBundleURL(u)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	_imports.update(job, func(job *ImportJob) { job.Size = size })
+	if size > maxBundleSize() {
+		return nil, ErrBundleTooLarge
+	}
+	bundle, err := newBundle()
+	if err != nil {
+		return nil, err
+	}
+	defer bundle.Cleanup()
+	hash := sha256.New()
+	progress := &progressReader{R: io.TeeReader(reader, hash), Bytes: job.read}
+	if err := bundle.Unpack(progress); err != nil {
+		return nil, err
+	}
+	// read archive padding to get checksum of complete bundle
+	if _, err := io.Copy(io.Discard, &limitedReader{R: progress, N: maxBundleSize()}); err != nil {
+		return nil, err
+	}
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	if job.Checksum != "" && job.Checksum != checksum {
+		return nil, fmt.Errorf("bundle checksum mismatch, expected %s got %s", job.Checksum, checksum)
+	}
+	_imports.update(job, func(job *ImportJob) { job.Checksum = checksum })
+	report := bundle.Report()
+	if !report.Valid {
+		return &report, errors.New(report.Error)
+	}
+	if job.DryRun {
+		return &report, nil
+	}
+	if err := bundle.authorize(job.identity); err != nil {
+		return &report, err
+	}
+	return &report, bundle.Activate()
+}
+
+// ImportHandler starts asynchronous import of the bundle from given URL, e.g.
+// curl -X POST -d '{"url": "https://host/model.tar.gz", "checksum": "<sha256>"}' /imports
+// and lists import jobs
+func ImportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		responseJSON(w, _imports.list(requestIdentity(r)))
+		return
+	}
+	defer r.Body.Close()
+	var req ImportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		responseError(w, "unable to decode import request", err, http.StatusBadRequest)
+		return
+	}
+	u, err := checkImportURL(req.URL)
+	if err != nil {
+		responseError(w, fmt.Sprintf("invalid import URL: %v", err), err, http.StatusBadRequest)
+		return
+	}
+	if dryRun(r) {
+		req.DryRun = true
+	}
+	// import jobs are visible to clients, therefore we keep only redacted URL
+	req.URL = redactedURL(u)
+	job, err := _imports.add(req, requestIdentity(r))
+	if err != nil {
+		w.Header().Set("Retry-After", "60")
+		responseError(w, fmt.Sprintf("unable to start import: %v", err), err, http.StatusServiceUnavailable)
+		return
+	}
+	log.Printf("import %s from %s", job.ID, req.URL)
+	go runImport(job, u)
+	snapshot, _ := _imports.get(job.ID)
+	w.Header().Set("Location", basePath(fmt.Sprintf("/imports/%s", job.ID)))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(snapshot)
+}
+
+// ImportJobHandler returns status of import job, jobs of other clients are
+// reported as unknown
+func ImportJobHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	job, ok := _imports.get(id)
+	if !ok || !job.visible(requestIdentity(r)) {
+		msg := fmt.Sprintf("unknown import job %s", id)
+		responseError(w, msg, nil, http.StatusNotFound)
+		return
+	}
+	responseJSON(w, job)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// helper function to run import job of given URL and return its final state
+func testImport(t *testing.T, rurl string) ImportJob {
+	u, err := checkImportURL(rurl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err := _imports.add(ImportRequest{URL: rurl, DryRun: true}, Identity{Name: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		runImport(job, u)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("import job is stuck")
+	}
+	snapshot, _ := _imports.get(job.ID)
+	return snapshot
+}
+
+// TestOpenBundleURL tests fetching of remote bundles
+func TestOpenBundleURL(t *testing.T) {
+	_config.ImportTimeout = 1
+	_config.ImportHosts = []string{"127.0.0.1"}
+	_config.MaxImports = 4
+	_config.MaxBundleSize = 1
+	_config.ModelDir = t.TempDir()
+	data := "bundle data"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/bundle.tar.gz":
+			w.Write([]byte(data))
+		case "/stalled.tar.gz":
+			w.Header().Set("Content-Length", "1000")
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL + "/bundle.tar.gz")
+	reader, size, err := openBundleURL(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil || string(body) != data || size != int64(len(data)) {
+		t.Errorf("unexpected bundle %q of size %d: %v", body, size, err)
+	}
+
+	// non-200 responses fail the import job
+	job := testImport(t, server.URL+"/missing.tar.gz")
+	if job.Status != ImportFailed || !strings.Contains(job.Error, "404") {
+		t.Errorf("unexpected job status %s error %s", job.Status, job.Error)
+	}
+
+	// stalled remotes fail the import job once timeout is reached
+	job = testImport(t, server.URL+"/stalled.tar.gz")
+	if job.Status != ImportFailed || !strings.Contains(job.Error, "Timeout") {
+		t.Errorf("unexpected job status %s error %s", job.Status, job.Error)
+	}
+
+	// internal addresses are not allowed unless import hosts are configured
+	_config.ImportHosts = nil
+	u, _ = url.Parse(server.URL + "/bundle.tar.gz?token=secret")
+	if _, _, err := openBundleURL(u); err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Errorf("loopback address should not be allowed: %v", err)
+	} else if strings.Contains(err.Error(), "secret") {
+		t.Errorf("error exposes query of the URL: %v", err)
+	}
+}
+
+// TestImportJobs tests limit of unfinished import jobs
+func TestImportJobs(t *testing.T) {
+	_imports = ImportJobs{Jobs: make(map[string]*ImportJob)}
+	_config.MaxImports = 2
+	for i := 0; i < 3; i++ {
+		_, err := _imports.add(ImportRequest{URL: "https://store/bundle.tar.gz"}, Identity{Name: "test"})
+		if i < 2 && err != nil {
+			t.Fatal(err)
+		}
+		if i == 2 && err != ErrTooManyImports {
+			t.Errorf("unexpected error %v", err)
+		}
+	}
+}
+
+// TestCheckImportURL tests that bundles are imported only from allowed areas
+func TestCheckImportURL(t *testing.T) {
+	dir := t.TempDir()
+	_config.ImportDirs = []string{filepath.Join(dir, "imports")}
+	_config.ImportHosts = nil
+	fname := filepath.Join(dir, "imports", "bundle.tar.gz")
+	if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, rurl := range []string{"https://store/bundle.tar.gz", "file://" + fname} {
+		if _, err := checkImportURL(rurl); err != nil {
+			t.Errorf("%s should be allowed: %v", rurl, err)
+		}
+	}
+	for _, rurl := range []string{
+		"ftp://store/bundle.tar.gz",
+		"file:///etc/passwd",
+		"file://" + filepath.Join(dir, "bundle.tar.gz"),
+		"file://" + filepath.Join(dir, "imports", "..", "bundle.tar.gz"),
+	} {
+		if _, err := checkImportURL(rurl); err == nil {
+			t.Errorf("%s should not be allowed", rurl)
+		}
+	}
+}
+
+// TestImportHosts tests that remote bundles are imported only from allowed hosts
+func TestImportHosts(t *testing.T) {
+	_config.ImportHosts = []string{"store.cern.ch"}
+	defer func() { _config.ImportHosts = nil }()
+	if _, err := checkImportURL("https://store.cern.ch/bundle.tar.gz"); err != nil {
+		t.Errorf("allowed host is rejected: %v", err)
+	}
+	if _, err := checkImportURL("http://169.254.169.254/latest/meta-data"); err == nil {
+		t.Error("host which is not listed should not be allowed")
+	}
+	_config.ImportHosts = nil
+	for ip, allowed := range map[string]bool{
+		"127.0.0.1": false, "10.1.2.3": false, "192.168.0.1": false,
+		"169.254.169.254": false, "::1": false, "0.0.0.0": false,
+		"188.184.9.234": true,
+	} {
+		if allowedImportIP(net.ParseIP(ip)) != allowed {
+			t.Errorf("address %s should be allowed=%v", ip, allowed)
+		}
+	}
+}
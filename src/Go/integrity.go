@@ -0,0 +1,293 @@
+package main
+
+// integrity module provides checksums and signature verification of model files
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ChecksumFile defines name of checksums manifest within model area, it uses
+// sha256sum format, i.e. "<sha256>  <file>" lines sorted by file name
+const ChecksumFile = "checksums.sha256"
+
+// SignatureFile defines name of detached ed25519 signature of checksums manifest
+const SignatureFile = "checksums.sig"
+
+// files of model area which are not part of checksums manifest
+var manifestSkip = []string{ChecksumFile, SignatureFile, EvaluationFile, MetadataFile}
+
+// trusted public keys used to verify model signatures
+var _trustedKeys []ed25519.PublicKey
+var _trustedKeysOnce sync.Once
+
+// helper function to compute SHA-256 digest of given file
+func fileDigest(fname string) (string, error) {
+	file, err := os.Open(fname)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// helper function to compute SHA-256 digests of all files in model area
+func computeChecksums(path string) (map[string]string, error) {
+	checksums := make(map[string]string)
+	err := filepath.Walk(path, func(fname string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(path, fname)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if InList(rel, manifestSkip) {
+			return nil
+		}
+		digest, err := fileDigest(fname)
+		if err != nil {
+			return err
+		}
+		checksums[rel] = digest
+		return nil
+	})
+	return checksums, err
+}
+
+// helper function to format checksums manifest
+func formatChecksums(checksums map[string]string) []byte {
+	var files []string
+	for f := range checksums {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+	var buf bytes.Buffer
+	for _, f := range files {
+		buf.WriteString(fmt.Sprintf("%s  %s\n", checksums[f], f))
+	}
+	return buf.Bytes()
+}
+
+// helper function to parse checksums manifest, it accepts output of
+// sha256sum tool including "./" prefix of file names
+func parseChecksums(data []byte) (map[string]string, error) {
+	checksums := make(map[string]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) != 2 || len(parts[0]) != sha256.Size*2 {
+			return checksums, fmt.Errorf("invalid checksums line %d: %s", i+1, line)
+		}
+		fname := strings.TrimPrefix(strings.TrimLeft(parts[1], " *"), "./")
+		if !filepath.IsLocal(fname) {
+			return checksums, fmt.Errorf("checksums file %s points outside of model area", fname)
+		}
+		checksums[filepath.ToSlash(fname)] = strings.ToLower(parts[0])
+	}
+	return checksums, nil
+}
+
+// helper function to read checksums manifest of given model area
+func readChecksums(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(path, ChecksumFile))
+	if err != nil {
+		return nil, err
+	}
+	return parseChecksums(data)
+}
+
+// helper function to compare checksums of model area with its manifest
+func compareChecksums(expect, found map[string]string) error {
+	for f, digest := range expect {
+		d, ok := found[f]
+		if !ok {
+			return fmt.Errorf("file %s listed in checksums is missing", f)
+		}
+		if d != digest {
+			return fmt.Errorf("checksum mismatch of %s", f)
+		}
+	}
+	for f := range found {
+		if _, ok := expect[f]; !ok {
+			return fmt.Errorf("file %s is not listed in checksums", f)
+		}
+	}
+	return nil
+}
+
+// helper function to verify integrity of model area before we load it,
+// model areas without checksums are accepted unless signatures are required
+func verifyModelArea(path string) error {
+	manifest, err := ioutil.ReadFile(filepath.Join(path, ChecksumFile))
+	if err != nil {
+		if os.IsNotExist(err) && !_config.RequireSignature {
+			if VERBOSE > 0 {
+				log.Println("model area", path, "does not provide checksums")
+			}
+			return nil
+		}
+		return err
+	}
+	expect, err := parseChecksums(manifest)
+	if err != nil {
+		return err
+	}
+	found, err := computeChecksums(path)
+	if err != nil {
+		return err
+	}
+	if err := compareChecksums(expect, found); err != nil {
+		return fmt.Errorf("model area %s: %v", path, err)
+	}
+	return verifySignature(path, manifest)
+}
+
+// helper function to verify detached signature of checksums manifest
+// against trusted public keys
+func verifySignature(path string, manifest []byte) error {
+	data, err := ioutil.ReadFile(filepath.Join(path, SignatureFile))
+	if err != nil {
+		if os.IsNotExist(err) && !_config.RequireSignature {
+			return nil
+		}
+		if os.IsNotExist(err) {
+			return errors.New("model is not signed")
+		}
+		return err
+	}
+	sig := data
+	if len(sig) != ed25519.SignatureSize {
+		// signature may be base64 encoded
+		sig, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(sig) != ed25519.SignatureSize {
+			return errors.New("invalid ed25519 signature")
+		}
+	}
+	for _, key := range trustedKeys() {
+		if ed25519.Verify(key, manifest, sig) {
+			return nil
+		}
+	}
+	return errors.New("model signature is not verified by any trusted key")
+}
+
+// helper function to get trusted public keys from server configuration
+func trustedKeys() []ed25519.PublicKey {
+	_trustedKeysOnce.Do(func() {
+		for _, fname := range _config.TrustedKeys {
+			data, err := ioutil.ReadFile(fname)
+			if err != nil {
+				log.Println("unable to read trusted key", fname, err)
+				continue
+			}
+			key, err := parsePublicKey(data)
+			if err != nil {
+				log.Println("unable to parse trusted key", fname, err)
+				continue
+			}
+			_trustedKeys = append(_trustedKeys, key)
+		}
+	})
+	return _trustedKeys
+}
+
+// helper function to parse ed25519 public key, it accepts PEM encoded key
+// (e.g. produced by openssl pkey -pubout) or base64 encoded raw key
+func parsePublicKey(data []byte) (ed25519.PublicKey, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := pub.(ed25519.PublicKey)
+		if !ok {
+			return nil, errors.New("public key is not ed25519 key")
+		}
+		return key, nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid ed25519 public key size")
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+// helper function to seal uploaded model area, i.e. verify checksums
+// provided by the bundle or compute and store them, and verify model signature
+func sealModelArea(path string, report *ModelReport) bool {
+	found, err := computeChecksums(path)
+	if err != nil {
+		report.errorf("unable to compute checksums: %v", err)
+		return false
+	}
+	manifest, err := ioutil.ReadFile(filepath.Join(path, ChecksumFile))
+	if err == nil {
+		expect, err := parseChecksums(manifest)
+		if err != nil {
+			report.errorf("%v", err)
+			return false
+		}
+		if err := compareChecksums(expect, found); err != nil {
+			report.errorf("%v", err)
+			return false
+		}
+	} else if os.IsNotExist(err) {
+		if _, err := os.Stat(filepath.Join(path, SignatureFile)); err == nil {
+			report.errorf("signature requires %s manifest provided by the bundle", ChecksumFile)
+			return false
+		}
+		manifest = formatChecksums(found)
+		if err := ioutil.WriteFile(filepath.Join(path, ChecksumFile), manifest, 0644); err != nil {
+			report.errorf("unable to store checksums: %v", err)
+			return false
+		}
+	} else {
+		report.errorf("unable to read checksums: %v", err)
+		return false
+	}
+	if err := verifySignature(path, manifest); err != nil {
+		report.errorf("%v", err)
+		return false
+	}
+	return true
+}
+
+// helper function to get checksums of the model, models without checksums
+// manifest have no checksums
+func modelChecksums(name string) map[string]string {
+	checksums, err := readChecksums(fmt.Sprintf("%s/%s", _config.ModelDir, name))
+	if err != nil && !os.IsNotExist(err) {
+		log.Println("unable to read checksums of", name, err)
+	}
+	return checksums
+}
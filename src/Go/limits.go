@@ -0,0 +1,384 @@
+package main
+
+// limits module provides rate limits and daily quotas of clients
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	limiter "github.com/ulule/limiter/v3"
+	memory "github.com/ulule/limiter/v3/drivers/store/memory"
+)
+
+// route groups of rate limits
+const (
+	LimitRead    = "read"    // models, their metadata and web UI
+	LimitPredict = "predict" // predictions
+	LimitUpload  = "upload"  // uploads, imports, pipelines and deletion of models
+	LimitAdmin   = "admin"   // admin APIs
+)
+
+// route group of routes which require given role
+var _roleLimits = map[string]string{
+	RoleReader:    LimitRead,
+	RolePredictor: LimitPredict,
+	RoleUploader:  LimitUpload,
+	RoleAdmin:     LimitAdmin,
+}
+
+// Quota defines daily quota of a group of clients
+type Quota struct {
+	Requests    int64   `json:"requests"`    // number of requests per day, zero means unlimited
+	ComputeTime float64 `json:"computeTime"` // time in seconds spent in predictions per day, zero means unlimited
+}
+
+// Usage represents usage of daily quota
+type Usage struct {
+	Day         string  `json:"day"`         // day of usage in UTC
+	Requests    int64   `json:"requests"`    // number of requests
+	ComputeTime float64 `json:"computeTime"` // time in seconds spent in predictions
+}
+
+// RateLimits keeps rate limiters of clients, each client has its own rate
+// in every limiter
+type RateLimits struct {
+	IP     *limiter.Limiter            // limit of all requests of IP address
+	Global *limiter.Limiter            // limit of all requests
+	Groups map[string]*limiter.Limiter // limits of route groups
+	Models map[string]*limiter.Limiter // limits of predictions of models
+}
+
+// global rate limits
+var _limits RateLimits
+
+// Quotas keeps daily usage of quotas
+type Quotas struct {
+	Usage map[string]*Usage // quota key => usage
+	Day   string            // day of the last check of quotas
+	mu    sync.Mutex
+}
+
+// global quotas
+var _quotas = Quotas{Usage: make(map[string]*Usage)}
+
+// helper function to create rate limiter for given rate, e.g. 100-S
+func newLimiter(rate string) (*limiter.Limiter, error) {
+	r, err := limiter.NewRateFromFormatted(rate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rate %s: %v", rate, err)
+	}
+	return limiter.New(memory.NewStore(), r), nil
+}
+
+// initialize rate limits from server configuration
+func initLimiter() error {
+	log.Printf("limiter rate='%s' ipRate='%s'", _config.LimiterPeriod, _config.IPLimiterPeriod)
+	ip, err := newLimiter(_config.IPLimiterPeriod)
+	if err != nil {
+		return err
+	}
+	global, err := newLimiter(_config.LimiterPeriod)
+	if err != nil {
+		return err
+	}
+	limits := RateLimits{
+		IP:     ip,
+		Global: global,
+		Groups: make(map[string]*limiter.Limiter),
+		Models: make(map[string]*limiter.Limiter),
+	}
+	for group, rate := range _config.RateLimits {
+		switch group {
+		case LimitRead, LimitPredict, LimitUpload, LimitAdmin:
+		default:
+			return fmt.Errorf("unknown route group %s", group)
+		}
+		if limits.Groups[group], err = newLimiter(rate); err != nil {
+			return err
+		}
+	}
+	for model, rate := range _config.ModelRateLimits {
+		if limits.Models[model], err = newLimiter(rate); err != nil {
+			return err
+		}
+	}
+	_limits = limits
+	return nil
+}
+
+// helper function to get key of the client used by rate limits, anonymous
+// clients are identified by their IP address
+func clientKey(r *http.Request) string {
+	id := requestIdentity(r)
+	if id.Method == "anonymous" {
+		return ipKey(r)
+	}
+	return id.Method + ":" + id.Name
+}
+
+// helper function to get key of IP address of the client
+func ipKey(r *http.Request) string {
+	return "ip:" + _limits.IP.GetIPKey(r)
+}
+
+// helper function to set rate limit headers, e.g. RateLimit-Limit,
+// RateLimit-Remaining and RateLimit-Reset (in seconds), of the most
+// restrictive limit applied to the request
+func setRateHeaders(w http.ResponseWriter, ctx limiter.Context) {
+	if v := w.Header().Get("RateLimit-Remaining"); v != "" {
+		if remaining, err := strconv.ParseInt(v, 10, 64); err == nil && remaining <= ctx.Remaining {
+			return
+		}
+	}
+	reset := ctx.Reset - time.Now().Unix()
+	if reset < 0 {
+		reset = 0
+	}
+	w.Header().Set("RateLimit-Limit", strconv.FormatInt(ctx.Limit, 10))
+	w.Header().Set("RateLimit-Remaining", strconv.FormatInt(ctx.Remaining, 10))
+	w.Header().Set("RateLimit-Reset", strconv.FormatInt(reset, 10))
+}
+
+// helper function to check rate limit of the client, it returns false and
+// writes 429 response if the limit is reached
+func checkRate(w http.ResponseWriter, r *http.Request, l *limiter.Limiter, scope string) bool {
+	return checkKeyRate(w, r, l, clientKey(r), scope)
+}
+
+// helper function to check rate limit of given key, it returns false and
+// writes 429 response if the limit is reached
+func checkKeyRate(w http.ResponseWriter, r *http.Request, l *limiter.Limiter, key, scope string) bool {
+	ctx, err := l.Get(r.Context(), key)
+	if err != nil {
+		// do not reject clients if limiter is not available
+		log.Println("unable to get rate limit", err)
+		return true
+	}
+	setRateHeaders(w, ctx)
+	if ctx.Reached {
+		retry := ctx.Reset - time.Now().Unix()
+		if retry < 1 {
+			retry = 1
+		}
+		w.Header().Set("Retry-After", strconv.FormatInt(retry, 10))
+		msg := fmt.Sprintf("%s rate limit is reached", scope)
+		responseError(w, msg, nil, http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
+
+// helper function to get current day of quotas
+func quotaDay() string {
+	return time.Now().UTC().Format("2006-01-02")
+}
+
+// helper function to get quotas of the client, group quotas are shared by
+// group members while "*" quota applies to every client
+func clientQuotas(r *http.Request) map[string]Quota {
+	quotas := make(map[string]Quota)
+	for _, group := range requestIdentity(r).Groups {
+		if quota, ok := _config.Quotas[group]; ok {
+			quotas["group:"+group] = quota
+		}
+	}
+	if quota, ok := _config.Quotas["*"]; ok {
+		quotas[clientKey(r)] = quota
+	}
+	return quotas
+}
+
+// helper function to get usage of quota for current day, it should be called
+// with acquired lock
+func (q *Quotas) usage(key string) *Usage {
+	day := quotaDay()
+	usage, ok := q.Usage[key]
+	if !ok || usage.Day != day {
+		usage = &Usage{Day: day}
+		q.Usage[key] = usage
+	}
+	return usage
+}
+
+// helper function to drop usage of past days, e.g. of anonymous clients
+// which are not seen anymore, it should be called with acquired lock
+func (q *Quotas) prune() {
+	day := quotaDay()
+	if q.Day == day {
+		return
+	}
+	for key, usage := range q.Usage {
+		if usage.Day != day {
+			delete(q.Usage, key)
+		}
+	}
+	q.Day = day
+}
+
+// check verifies that none of given quotas is exhausted and counts the request
+func (q *Quotas) check(quotas map[string]Quota) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.prune()
+	for key, quota := range quotas {
+		usage := q.usage(key)
+		if quota.Requests > 0 && usage.Requests >= quota.Requests {
+			return fmt.Errorf("daily quota of %d requests of %s is exhausted", quota.Requests, key)
+		}
+		if quota.ComputeTime > 0 && usage.ComputeTime >= quota.ComputeTime {
+			return fmt.Errorf("daily quota of %v seconds of compute time of %s is exhausted", quota.ComputeTime, key)
+		}
+	}
+	for key := range quotas {
+		q.usage(key).Requests++
+	}
+	return nil
+}
+
+// charge adds compute time to given quotas
+func (q *Quotas) charge(quotas map[string]Quota, elapsed time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for key := range quotas {
+		q.usage(key).ComputeTime += elapsed.Seconds()
+	}
+}
+
+// get returns usage of given quota
+func (q *Quotas) get(key string) Usage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return *q.usage(key)
+}
+
+// helper function to get time until the end of current day of quotas
+func quotaReset() time.Duration {
+	now := time.Now().UTC()
+	return now.Truncate(24 * time.Hour).Add(24 * time.Hour).Sub(now)
+}
+
+// ipLimitMiddleware limits all incoming requests of IP address, it is applied
+// before authentication such that clients with invalid credentials are limited
+func ipLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !checkKeyRate(w, r, _limits.IP, ipKey(r), "ip") {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limit middleware limits all incoming requests of the client
+func limitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !checkRate(w, r, _limits.Global, "global") {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rateMiddleware applies rate limit and quotas of given route group,
+// compute time of predictions is charged to quotas of the client
+func rateMiddleware(group string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if l, ok := _limits.Groups[group]; ok && !checkRate(w, r, l, group) {
+				return
+			}
+			quotas := clientQuotas(r)
+			if err := _quotas.check(quotas); err != nil {
+				w.Header().Set("Retry-After", strconv.FormatInt(int64(quotaReset().Seconds())+1, 10))
+				responseError(w, err.Error(), err, http.StatusTooManyRequests)
+				return
+			}
+			start := time.Now()
+			next.ServeHTTP(w, r)
+			if group == LimitPredict && len(quotas) > 0 {
+				_quotas.charge(quotas, time.Since(start))
+			}
+		})
+	}
+}
+
+// helper function to check rate limit of predictions of given model, it
+// returns false and writes 429 response if the limit is reached
+func allowModel(w http.ResponseWriter, r *http.Request, model string) bool {
+	l, ok := _limits.Models[model]
+	if !ok {
+		return true
+	}
+	return checkRate(w, r, l, fmt.Sprintf("model %s", model))
+}
+
+// RateUsage represents usage of rate limit
+type RateUsage struct {
+	Scope     string `json:"scope"`     // global, route group or model
+	Limit     int64  `json:"limit"`     // number of requests per period
+	Remaining int64  `json:"remaining"` // remaining number of requests
+	Reset     int64  `json:"reset"`     // seconds until limit is reset
+}
+
+// QuotaUsage represents usage of daily quota
+type QuotaUsage struct {
+	Name  string `json:"name"`  // group or client of the quota
+	Quota Quota  `json:"quota"` // quota limits
+	Usage Usage  `json:"usage"` // usage of current day
+	Reset int64  `json:"reset"` // seconds until quota is reset
+}
+
+// helper function to get sorted names of rate limiters
+func sortedKeys(limiters map[string]*limiter.Limiter) []string {
+	var keys []string
+	for key := range limiters {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// UsageHandler returns current usage of rate limits and quotas of the client
+func UsageHandler(w http.ResponseWriter, r *http.Request) {
+	key := clientKey(r)
+	var limits []RateUsage
+	peek := func(scope string, l *limiter.Limiter, key string) {
+		ctx, err := l.Peek(r.Context(), key)
+		if err != nil {
+			log.Println("unable to get rate limit", err)
+			return
+		}
+		reset := ctx.Reset - time.Now().Unix()
+		if reset < 0 {
+			reset = 0
+		}
+		limits = append(limits, RateUsage{Scope: scope, Limit: ctx.Limit, Remaining: ctx.Remaining, Reset: reset})
+	}
+	peek("ip", _limits.IP, ipKey(r))
+	peek("global", _limits.Global, key)
+	for _, name := range sortedKeys(_limits.Groups) {
+		peek(name, _limits.Groups[name], key)
+	}
+	for _, name := range sortedKeys(_limits.Models) {
+		peek("model:"+name, _limits.Models[name], key)
+	}
+	quotas := []QuotaUsage{}
+	for name, quota := range clientQuotas(r) {
+		quotas = append(quotas, QuotaUsage{
+			Name:  name,
+			Quota: quota,
+			Usage: _quotas.get(name),
+			Reset: int64(quotaReset().Seconds()),
+		})
+	}
+	sort.Slice(quotas, func(i, j int) bool { return quotas[i].Name < quotas[j].Name })
+	responseJSON(w, map[string]interface{}{
+		"client": key,
+		"limits": limits,
+		"quotas": quotas,
+	})
+}
@@ -58,6 +58,9 @@ func utcMsg(data []byte) string {
 	return s
 }
 
+// rotated log files of the server, they are closed on shutdown
+var _rotateLogs *rotatelogs.RotateLogs
+
 // custom rotate logger
 type rotateLogWriter struct {
 	RotateLogs *rotatelogs.RotateLogs
@@ -0,0 +1,244 @@
+package main
+
+// metadata module provides model metadata, search and pagination of models
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MetadataFile defines name of file with metadata of the model set by the server
+const MetadataFile = "metadata.json"
+
+// ModelMetadata represents metadata of the model set by the server at upload,
+// it is stored separately from params.json to not alter signed model files
+type ModelMetadata struct {
+	Uploaded   string `json:"uploaded,omitempty"`    // model upload time
+	InputNode  string `json:"input_node,omitempty"`  // input node inferred from TF 1.X graph
+	OutputNode string `json:"output_node,omitempty"` // output node inferred from TF 1.X graph
+	InputName  string `json:"input_name,omitempty"`  // input layer inferred from SavedModel
+	OutputName string `json:"output_name,omitempty"` // output layer inferred from SavedModel
+	Group      string `json:"group,omitempty"`       // group owning the model if the model does not declare it
+}
+
+// helper function to store model metadata in given model area
+func writeMetadata(path string, meta ModelMetadata) error {
+	data, err := json.MarshalIndent(meta, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(path, MetadataFile), data, 0644)
+}
+
+// helper function to read model metadata from given model area
+func readMetadata(path string) (ModelMetadata, error) {
+	var meta ModelMetadata
+	data, err := ioutil.ReadFile(filepath.Join(path, MetadataFile))
+	if err != nil {
+		return meta, err
+	}
+	err = json.Unmarshal(data, &meta)
+	return meta, err
+}
+
+// helper function to fill in model parameters provided by the server, i.e.
+// upload time and inferred input/output nodes which are not declared by the
+// model, model timestamp is stable, i.e. upload time or modification time of params.json
+func setMetadata(params *TFParams, fname string) {
+	if meta, err := readMetadata(filepath.Dir(fname)); err == nil {
+		params.Uploaded = meta.Uploaded
+		if params.InputNode == "" {
+			params.InputNode = meta.InputNode
+		}
+		if params.OutputNode == "" {
+			params.OutputNode = meta.OutputNode
+		}
+		if params.InputName == "" {
+			params.InputName = meta.InputName
+		}
+		if params.OutputName == "" {
+			params.OutputName = meta.OutputName
+		}
+		if params.Group == "" {
+			params.Group = meta.Group
+		}
+	}
+	if params.TimeStamp == "" {
+		if params.Uploaded != "" {
+			params.TimeStamp = params.Uploaded
+		} else if info, err := os.Stat(fname); err == nil {
+			params.TimeStamp = info.ModTime().Format(time.RFC3339)
+		}
+	}
+}
+
+// ModelQuery represents filters, sorting and pagination of models
+type ModelQuery struct {
+	Tags   []string // models should have all given tags
+	Owner  string   // model owner
+	Group  string   // model group
+	Query  string   // case insensitive search in model name, description, tags and dataset
+	Sort   string   // sort key, e.g. name or -uploaded for descending order
+	Limit  int      // max number of models to return, zero means no limit
+	Offset int      // number of models to skip
+}
+
+// helper function to parse model query from URL query parameters, e.g.
+// /models?tag=cms&owner=alice&q=btag&sort=-uploaded&limit=10&offset=20
+func parseModelQuery(values url.Values) (ModelQuery, error) {
+	query := ModelQuery{
+		Tags:  values["tag"],
+		Owner: values.Get("owner"),
+		Group: values.Get("group"),
+		Query: strings.ToLower(values.Get("q")),
+		Sort:  values.Get("sort"),
+	}
+	if !InList(strings.TrimPrefix(query.Sort, "-"), []string{"", "name", "owner", "group", "version", "created", "uploaded", "timestamp"}) {
+		return query, fmt.Errorf("unsupported sort key %s", query.Sort)
+	}
+	for key, ptr := range map[string]*int{"limit": &query.Limit, "offset": &query.Offset} {
+		if v := values.Get(key); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return query, fmt.Errorf("invalid %s value %s", key, v)
+			}
+			*ptr = n
+		}
+	}
+	return query, nil
+}
+
+// helper function to check if model matches the query
+func (q *ModelQuery) match(p TFParams) bool {
+	if q.Owner != "" && p.Owner != q.Owner {
+		return false
+	}
+	if q.Group != "" && p.Group != q.Group {
+		return false
+	}
+	for _, tag := range q.Tags {
+		if !InList(tag, p.Tags) {
+			return false
+		}
+	}
+	if q.Query != "" {
+		text := strings.ToLower(strings.Join(append([]string{p.Name, p.Description, p.Dataset}, p.Tags...), " "))
+		if !strings.Contains(text, q.Query) {
+			return false
+		}
+	}
+	return true
+}
+
+// helper function to get sort key of the model
+func sortKey(p TFParams, key string) string {
+	switch key {
+	case "owner":
+		return p.Owner
+	case "group":
+		return p.Group
+	case "version":
+		return p.Version
+	case "created":
+		return p.Created
+	case "uploaded":
+		return p.Uploaded
+	case "timestamp":
+		return p.TimeStamp
+	}
+	return p.Name
+}
+
+// Apply filters, sorts and paginates given models, it returns selected models
+// along with total number of matched models
+func (q *ModelQuery) Apply(models []TFParams) ([]TFParams, int) {
+	var out []TFParams
+	for _, p := range models {
+		if q.match(p) {
+			out = append(out, p)
+		}
+	}
+	key := strings.TrimPrefix(q.Sort, "-")
+	desc := strings.HasPrefix(q.Sort, "-")
+	sort.SliceStable(out, func(i, j int) bool {
+		ki, kj := sortKey(out[i], key), sortKey(out[j], key)
+		if ki == kj {
+			return out[i].Name < out[j].Name
+		}
+		if desc {
+			return ki > kj
+		}
+		return ki < kj
+	})
+	total := len(out)
+	if q.Offset >= total {
+		return []TFParams{}, total
+	}
+	out = out[q.Offset:]
+	if q.Limit > 0 && q.Limit < len(out) {
+		out = out[:q.Limit]
+	}
+	return out, total
+}
+
+// HistoryArea defines name of area within model directory which keeps
+// version history of models, it is hidden such that it is not listed as a model
+const HistoryArea = ".history"
+
+// ModelVersion represents single version of the model in its history
+type ModelVersion struct {
+	Version     string `json:"version"`     // model version
+	Description string `json:"description"` // model description
+	TimeStamp   string `json:"timestamp"`   // model timestamp
+	Uploaded    string `json:"uploaded"`    // upload time of the version
+}
+
+// helper function to read version history of the model
+func modelHistory(name string) ([]ModelVersion, error) {
+	var history []ModelVersion
+	data, err := ioutil.ReadFile(filepath.Join(_config.ModelDir, HistoryArea, name+".json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return history, nil
+		}
+		return history, err
+	}
+	err = json.Unmarshal(data, &history)
+	return history, err
+}
+
+// helper function to add current version of the model to its history,
+// callers should serialize model activations
+func recordHistory(name string) error {
+	params, err := readParams(name)
+	if err != nil {
+		return err
+	}
+	history, err := modelHistory(name)
+	if err != nil {
+		return err
+	}
+	history = append(history, ModelVersion{
+		Version:     params.Version,
+		Description: params.Description,
+		TimeStamp:   params.TimeStamp,
+		Uploaded:    params.Uploaded,
+	})
+	data, err := json.MarshalIndent(history, "", "    ")
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(_config.ModelDir, HistoryArea)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, name+".json"), data, 0644)
+}
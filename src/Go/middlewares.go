@@ -8,47 +8,32 @@ import (
 	"net/url"
 	"sync/atomic"
 	"time"
-
-	limiter "github.com/ulule/limiter/v3"
-	stdlib "github.com/ulule/limiter/v3/drivers/middleware/stdlib"
-	memory "github.com/ulule/limiter/v3/drivers/store/memory"
 )
 
-// limiter middleware pointer
-var limiterMiddleware *stdlib.Middleware
-
-// initialize Limiter middleware pointer
-func initLimiter(period string) {
-	log.Printf("limiter rate='%s'", period)
-	// create rate limiter with 5 req/second
-	rate, err := limiter.NewRateFromFormatted(period)
-	if err != nil {
-		panic(err)
-	}
-	store := memory.NewStore()
-	instance := limiter.New(store, rate)
-	limiterMiddleware = stdlib.NewMiddleware(instance)
-}
-
-/*
-// helper to auth/authz incoming requests to the server
+// helper to auth/authz incoming requests to the server, it stores identity
+// of the client in request context
 func authMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// perform authentication
-		status := CMSAuth.CheckAuthnAuthz(r.Header)
-		if !status {
-			log.Printf("ERROR: fail to authenticate, HTTP headers %+v\n", r.Header)
-			w.WriteHeader(http.StatusForbidden)
+		id, code, err := auth(r)
+		if err != nil {
+			msg := "unable to authenticate client"
+			if code == http.StatusForbidden {
+				msg = fmt.Sprintf("user %s is not authorized", id.Name)
+			}
+			if code == http.StatusUnauthorized {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+			}
+			responseError(w, msg, err, code)
 			return
 		}
-		if Config.Verbose > 2 {
-			log.Printf("Auth layer status: %v headers: %+v\n", status, r.Header)
+		if VERBOSE > 2 {
+			log.Printf("Auth layer identity: %+v\n", id)
 		}
 		// Call the next handler
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, withIdentity(r, id))
 	})
 }
-*/
 
 // Validate should implement input validation
 func Validate(r *http.Request) error {
@@ -80,13 +65,6 @@ func validateMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-// limit middleware limits incoming requests
-func limitMiddleware(next http.Handler) http.Handler {
-	return limiterMiddleware.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		next.ServeHTTP(w, r)
-	}))
-}
-
 // responseWriter is a minimal wrapper for http.ResponseWriter that allows the
 // written HTTP status code to be captured for logging.
 type responseWriter struct {
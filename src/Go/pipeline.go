@@ -0,0 +1,430 @@
+package main
+
+// pipeline module provides multi-stage inference pipelines (DAG of models)
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// PipelineFile defines name of pipeline definition file within model area
+const PipelineFile = "pipeline.json"
+
+// PipelineInput defines reserved name of the pipeline input
+const PipelineInput = "input"
+
+// Pipeline represents multi-stage inference pipeline, i.e. DAG of models and
+// transforms. It is stored in ModelDir/<name>/pipeline.json
+type Pipeline struct {
+	Name        string          `json:"name"`        // pipeline name
+	Description string          `json:"description"` // pipeline description
+	Stages      []PipelineStage `json:"stages"`      // pipeline stages
+	Output      []string        `json:"output"`      // output stages, first executed one is used
+
+	order []PipelineStage // validated stages in execution order
+}
+
+// PipelineStage represents single stage of the pipeline
+type PipelineStage struct {
+	Name      string          `json:"name"`      // stage name
+	Model     string          `json:"model"`     // TF model to run, empty for pure transforms
+	Transform string          `json:"transform"` // transform applied to stage output
+	Args      []int           `json:"args"`      // transform arguments, e.g. slice boundaries
+	Inputs    []string        `json:"inputs"`    // pipeline input or upstream stages
+	When      *StageCondition `json:"when"`      // optional condition to run the stage
+}
+
+// StageCondition allows to run a stage only if upstream stage selected it
+type StageCondition struct {
+	Stage string `json:"stage"` // upstream stage name
+	Index int    `json:"index"` // run stage if argmax of upstream output equals index
+}
+
+// StageTiming represents execution metadata of single pipeline stage
+type StageTiming struct {
+	Name    string  `json:"name"`    // stage name
+	Model   string  `json:"model"`   // stage model
+	Time    float64 `json:"time"`    // execution time in seconds
+	Skipped bool    `json:"skipped"` // stage was skipped by its condition
+}
+
+// PipelineMetadata represents pipeline execution metadata
+type PipelineMetadata struct {
+	Pipeline string        `json:"pipeline"` // pipeline name
+	Output   string        `json:"output"`   // stage used as pipeline output
+	Stages   []StageTiming `json:"stages"`   // per-stage timings
+	Time     float64       `json:"time"`     // total execution time in seconds
+}
+
+// PipelineResult represents pipeline predictions along with its metadata
+type PipelineResult struct {
+	Predictions []float32        `json:"predictions"`
+	Metadata    PipelineMetadata `json:"metadata"`
+}
+
+// helper function to check if given stage transform is supported
+func validTransform(t string) bool {
+	switch t {
+	case "", "identity", "softmax", "sigmoid", "argmax", "slice":
+		return true
+	}
+	return false
+}
+
+// Validate checks pipeline definition and returns its stages in execution order
+func (p *Pipeline) Validate() ([]PipelineStage, error) {
+	if p.Name == "" {
+		return nil, errors.New("pipeline does not provide its name")
+	}
+	if !validModelName(p.Name) {
+		return nil, fmt.Errorf("invalid pipeline name '%s'", p.Name)
+	}
+	if len(p.Stages) == 0 {
+		return nil, errors.New("pipeline does not provide any stage")
+	}
+	stages := make(map[string]PipelineStage)
+	for _, s := range p.Stages {
+		if s.Name == "" || s.Name == PipelineInput {
+			return nil, fmt.Errorf("invalid stage name '%s'", s.Name)
+		}
+		if _, ok := stages[s.Name]; ok {
+			return nil, fmt.Errorf("duplicate stage '%s'", s.Name)
+		}
+		if s.Model == "" && s.Transform == "" {
+			return nil, fmt.Errorf("stage '%s' does not provide neither model nor transform", s.Name)
+		}
+		if !validTransform(s.Transform) {
+			return nil, fmt.Errorf("stage '%s' uses unknown transform '%s'", s.Name, s.Transform)
+		}
+		if s.Transform == "slice" && len(s.Args) != 2 {
+			return nil, fmt.Errorf("stage '%s' slice transform requires two arguments", s.Name)
+		}
+		if len(s.Inputs) == 0 {
+			return nil, fmt.Errorf("stage '%s' does not provide its inputs", s.Name)
+		}
+		if s.Model != "" {
+			if !validModelName(s.Model) {
+				return nil, fmt.Errorf("stage '%s' refers to invalid model name '%s'", s.Name, s.Model)
+			}
+			if s.Model == p.Name {
+				return nil, fmt.Errorf("stage '%s' refers to pipeline itself", s.Name)
+			}
+			flavor, err := tfVersion(s.Model)
+			if err != nil {
+				return nil, fmt.Errorf("stage '%s' refers to unknown model '%s'", s.Name, s.Model)
+			}
+			if flavor == "pipeline" {
+				return nil, fmt.Errorf("stage '%s' refers to another pipeline '%s'", s.Name, s.Model)
+			}
+		}
+		stages[s.Name] = s
+	}
+
+	// build dependency graph and check that all references are known
+	deps := make(map[string][]string)
+	for _, s := range p.Stages {
+		for _, in := range s.Inputs {
+			if in == PipelineInput {
+				continue
+			}
+			if _, ok := stages[in]; !ok {
+				return nil, fmt.Errorf("stage '%s' refers to unknown input '%s'", s.Name, in)
+			}
+			deps[s.Name] = append(deps[s.Name], in)
+		}
+		if s.When != nil {
+			if _, ok := stages[s.When.Stage]; !ok {
+				return nil, fmt.Errorf("stage '%s' condition refers to unknown stage '%s'", s.Name, s.When.Stage)
+			}
+			deps[s.Name] = append(deps[s.Name], s.When.Stage)
+		}
+	}
+	if len(p.Output) == 0 {
+		return nil, errors.New("pipeline does not provide its output stages")
+	}
+	for _, name := range p.Output {
+		if _, ok := stages[name]; !ok {
+			return nil, fmt.Errorf("pipeline output refers to unknown stage '%s'", name)
+		}
+	}
+
+	// topological sort of stages (Kahn algorithm), it preserves stages order
+	// whenever possible and detects cycles
+	indegree := make(map[string]int)
+	for _, s := range p.Stages {
+		indegree[s.Name] = len(deps[s.Name])
+	}
+	var order []PipelineStage
+	done := make(map[string]bool)
+	for len(order) < len(p.Stages) {
+		progress := false
+		for _, s := range p.Stages {
+			if done[s.Name] || indegree[s.Name] != 0 {
+				continue
+			}
+			done[s.Name] = true
+			order = append(order, s)
+			progress = true
+			for _, d := range p.Stages {
+				for _, dep := range deps[d.Name] {
+					if dep == s.Name {
+						indegree[d.Name]--
+					}
+				}
+			}
+		}
+		if !progress {
+			return nil, errors.New("pipeline stages contain a cycle")
+		}
+	}
+	return order, nil
+}
+
+// helper function to check if given model name represents a pipeline
+func isPipeline(name string) bool {
+	flavor, err := tfVersion(name)
+	return err == nil && flavor == "pipeline"
+}
+
+// helper function to read pipeline definition from model area
+func getPipeline(name string) (Pipeline, error) {
+	return readPipeline(fmt.Sprintf("%s/%s/%s", _config.ModelDir, name, PipelineFile))
+}
+
+// cachedPipeline represents validated pipeline along with its file info used
+// to detect changes of pipeline definition
+type cachedPipeline struct {
+	Pipeline Pipeline
+	Info     os.FileInfo
+}
+
+// PipelineCache keeps validated pipelines such that pipeline definitions are
+// not read and validated on every prediction
+type PipelineCache struct {
+	Pipelines map[string]cachedPipeline
+	mu        sync.RWMutex
+}
+
+// global cache of validated pipelines
+var _pipelines = PipelineCache{Pipelines: make(map[string]cachedPipeline)}
+
+// get returns validated pipeline with given name, the pipeline is read and
+// validated again if its definition was changed
+func (c *PipelineCache) get(name string) (Pipeline, error) {
+	fname := fmt.Sprintf("%s/%s/%s", _config.ModelDir, name, PipelineFile)
+	info, err := os.Stat(fname)
+	if err != nil {
+		return Pipeline{}, err
+	}
+	c.mu.RLock()
+	entry, ok := c.Pipelines[name]
+	c.mu.RUnlock()
+	if ok && os.SameFile(entry.Info, info) && entry.Info.ModTime().Equal(info.ModTime()) && entry.Info.Size() == info.Size() {
+		return entry.Pipeline, nil
+	}
+	p, err := readPipeline(fname)
+	if err != nil {
+		return p, err
+	}
+	if p.order, err = p.Validate(); err != nil {
+		return p, err
+	}
+	c.mu.Lock()
+	c.Pipelines[name] = cachedPipeline{Pipeline: p, Info: info}
+	c.mu.Unlock()
+	return p, nil
+}
+
+// helper function to read pipeline definition from given file
+func readPipeline(fname string) (Pipeline, error) {
+	var p Pipeline
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return p, err
+	}
+	err = json.Unmarshal(data, &p)
+	return p, err
+}
+
+// helper function to store pipeline definition in model area, the pipeline
+// is owned by given group, it is staged, sealed and activated as uploaded models
+func storePipeline(p Pipeline, group string) error {
+	bundle, err := newBundle()
+	if err != nil {
+		return err
+	}
+	defer bundle.Cleanup()
+	path := filepath.Join(bundle.Root, p.Name)
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(p, "", "    ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(path, PipelineFile), data, 0644); err != nil {
+		return err
+	}
+	now := time.Now().Format(time.RFC3339)
+	params := TFParams{
+		Name:        p.Name,
+		Description: p.Description,
+		Pipeline:    PipelineFile,
+		Group:       group,
+		TimeStamp:   now,
+		Created:     now,
+	}
+	data, err = json.MarshalIndent(params, "", "    ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(path, "params.json"), data, 0644); err != nil {
+		return err
+	}
+	bundle.Models = []string{p.Name}
+	report := bundle.Report()
+	if err := report.Err(); err != nil {
+		return err
+	}
+	return bundle.Activate()
+}
+
+// helper function to apply stage transform to given values
+func applyTransform(s PipelineStage, values []float32) ([]float32, error) {
+	switch s.Transform {
+	case "softmax":
+		var sum float64
+		out := make([]float32, len(values))
+		for i, v := range values {
+			e := math.Exp(float64(v))
+			out[i] = float32(e)
+			sum += e
+		}
+		for i := range out {
+			out[i] = float32(float64(out[i]) / sum)
+		}
+		return out, nil
+	case "sigmoid":
+		out := make([]float32, len(values))
+		for i, v := range values {
+			out[i] = float32(1 / (1 + math.Exp(-float64(v))))
+		}
+		return out, nil
+	case "argmax":
+		return []float32{float32(argmax(values))}, nil
+	case "slice":
+		start, end := s.Args[0], s.Args[1]
+		if start < 0 || end > len(values) || start > end {
+			return nil, fmt.Errorf("stage '%s' slice [%d:%d] is out of range of %d values", s.Name, start, end, len(values))
+		}
+		return values[start:end], nil
+	}
+	return values, nil
+}
+
+// helper function to find index of maximum value
+func argmax(values []float32) int {
+	idx := -1
+	for i, v := range values {
+		if idx == -1 || v > values[idx] {
+			idx = i
+		}
+	}
+	return idx
+}
+
+// Run executes pipeline stages for given input values, tensors are passed
+// between stages in-process, remaining stages are not executed once given
+// context is done, pipelines which were not validated yet are validated first
+func (p *Pipeline) Run(ctx context.Context, values []float32) (PipelineResult, error) {
+	result := PipelineResult{Metadata: PipelineMetadata{Pipeline: p.Name}}
+	time0 := time.Now()
+	var err error
+	order := p.order
+	if order == nil {
+		if order, err = p.Validate(); err != nil {
+			return result, err
+		}
+	}
+	outputs := make(map[string][]float32)
+	for _, s := range order {
+		start := time.Now()
+		timing := StageTiming{Name: s.Name, Model: s.Model}
+		run := true
+		if s.When != nil {
+			out, ok := outputs[s.When.Stage]
+			if !ok || argmax(out) != s.When.Index {
+				run = false
+			}
+		}
+		var input []float32
+		for _, in := range s.Inputs {
+			if in == PipelineInput {
+				input = append(input, values...)
+				continue
+			}
+			out, ok := outputs[in]
+			if !ok {
+				// upstream stage was skipped
+				run = false
+				break
+			}
+			input = append(input, out...)
+		}
+		if !run {
+			timing.Skipped = true
+			result.Metadata.Stages = append(result.Metadata.Stages, timing)
+			continue
+		}
+		output := input
+		if s.Model != "" {
+			if err := ctx.Err(); err != nil {
+				return result, fmt.Errorf("stage '%s' model '%s': %w", s.Name, s.Model, err)
+			}
+			output, err = makePredictions(ctx, &Row{Values: input, Model: s.Model})
+			if err != nil {
+				return result, fmt.Errorf("stage '%s' model '%s': %w", s.Name, s.Model, err)
+			}
+		}
+		output, err = applyTransform(s, output)
+		if err != nil {
+			return result, err
+		}
+		outputs[s.Name] = output
+		timing.Time = time.Since(start).Seconds()
+		result.Metadata.Stages = append(result.Metadata.Stages, timing)
+		if VERBOSE > 1 {
+			log.Printf("pipeline %s stage %s output %v", p.Name, s.Name, output)
+		}
+	}
+	for _, name := range p.Output {
+		if out, ok := outputs[name]; ok {
+			result.Predictions = out
+			result.Metadata.Output = name
+			break
+		}
+	}
+	result.Metadata.Time = time.Since(time0).Seconds()
+	if result.Metadata.Output == "" {
+		return result, errors.New("none of pipeline output stages was executed")
+	}
+	return result, nil
+}
+
+// helper function to run pipeline with given name for given row
+func makePipelinePredictions(ctx context.Context, name string, row *Row) (PipelineResult, error) {
+	p, err := _pipelines.get(name)
+	if err != nil {
+		return PipelineResult{}, err
+	}
+	return p.Run(ctx, row.Values)
+}
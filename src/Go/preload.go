@@ -0,0 +1,151 @@
+package main
+
+// preload module provides model preloading and warm-up
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// WarmupFile defines default name of warm-up samples file within model area
+const WarmupFile = "warmup.json"
+
+// helper function to read warm-up samples of the model in given model area,
+// the samples are stored as list of rows, e.g.
+// [{"values": [1,2,3]}, {"values": [4,5,6]}]
+func warmupSamples(path string, params TFParams) ([]Row, error) {
+	var rows []Row
+	name := params.Warmup
+	if name == "" {
+		name = WarmupFile
+	}
+	if !validFileName(name) {
+		return rows, fmt.Errorf("invalid warm-up file name %s", name)
+	}
+	fname := fmt.Sprintf("%s/%s", path, name)
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		if os.IsNotExist(err) && params.Warmup == "" {
+			// warm-up samples are optional
+			return rows, nil
+		}
+		return rows, err
+	}
+	err = json.Unmarshal(data, &rows)
+	return rows, err
+}
+
+// helper function to warm-up given model by running its samples through it,
+// model should be warmed up before we mark it as ready
+func warmUp(tfm *TFModel) error {
+	path := fmt.Sprintf("%s/%s", _config.ModelDir, tfm.Params.Name)
+	rows, err := warmupSamples(path, tfm.Params)
+	if err != nil {
+		return fmt.Errorf("unable to read warm-up samples of %s: %v", tfm.Params.Name, err)
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	time0 := time.Now()
+	for i, row := range rows {
+		if _, err := tfm.predict(row.Values); err != nil {
+			return fmt.Errorf("warm-up sample %d of %s failed: %v", i, tfm.Params.Name, err)
+		}
+	}
+	log.Printf("warm-up %s with %d samples in %v", tfm.Params.Name, len(rows), time.Since(time0))
+	return nil
+}
+
+// models which are kept in the cache, i.e. preloaded models and models
+// required by readiness probe along with models of their pipelines
+var _pinnedModels atomic.Value
+
+// helper function to check if given model should be preloaded
+func isPreloaded(params TFParams) bool {
+	return params.Preload || InList(params.Name, _config.Preload)
+}
+
+// helper function to check if given model should be kept in the cache, such
+// models are never evicted or unloaded when they are idle
+func isPinned(params TFParams) bool {
+	if isPreloaded(params) || InList(params.Name, _config.ReadyModels) {
+		return true
+	}
+	names, _ := _pinnedModels.Load().([]string)
+	return InList(params.Name, names)
+}
+
+// helper function to load (or reload) and warm-up given model, for
+// pipelines we preload all their models
+func preloadModel(name string) error {
+	if isPipeline(name) {
+		p, err := getPipeline(name)
+		if err != nil {
+			return err
+		}
+		for _, s := range p.Stages {
+			if s.Model == "" {
+				continue
+			}
+			if err := preloadModel(s.Model); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if _cache.loaded(name) {
+		return _cache.reload(name)
+	}
+	return _cache.add(name)
+}
+
+// helper function to preload models listed in server configuration, either
+// as preloaded or required by readiness probe, or marked as preload in their
+// parameters
+func preloadModels() {
+	names := append([]string{}, _config.Preload...)
+	for _, name := range _config.ReadyModels {
+		if !InList(name, names) {
+			names = append(names, name)
+		}
+	}
+	if pinned, err := readyModels(); err == nil {
+		_pinnedModels.Store(pinned)
+	}
+	models, err := TFModels()
+	if err != nil {
+		log.Println("unable to get list of models", err)
+	}
+	for _, params := range models {
+		if params.Preload && !InList(params.Name, names) {
+			names = append(names, params.Name)
+		}
+	}
+	for _, name := range names {
+		time0 := time.Now()
+		if err := preloadModel(name); err != nil {
+			log.Printf("unable to preload model %s: %v", name, err)
+			continue
+		}
+		log.Printf("preload model %s in %v", name, time.Since(time0))
+	}
+	atomic.StoreInt32(&_preloaded, 1)
+}
+
+// helper function to activate uploaded model, preloaded models are loaded
+// and warmed up right away while others are only reloaded if they were cached
+func activateModel(name string) error {
+	params, err := readParams(name)
+	if err != nil {
+		return err
+	}
+	if isPreloaded(params) {
+		return preloadModel(name)
+	}
+	return _cache.reload(name)
+}
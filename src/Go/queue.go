@@ -0,0 +1,287 @@
+package main
+
+// queue module provides per-model concurrency limits, bounded wait queues
+// with priority classes and load shedding
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// priority classes of requests, interactive requests are served before
+// batch ones and may shed queued batch requests
+const (
+	PriorityInteractive = "interactive"
+	PriorityBatch       = "batch"
+)
+
+// ErrQueueFull is returned when model queue is full and request is shed
+var ErrQueueFull = errors.New("model queue is full")
+
+// ErrQueueTimeout is returned when request waited in the queue too long
+var ErrQueueTimeout = errors.New("request waited in model queue too long")
+
+// Concurrency defines concurrency limits of a model
+type Concurrency struct {
+	MaxInflight  int `json:"maxInflight"`  // max number of concurrent inferences, zero means unlimited
+	MaxQueue     int `json:"maxQueue"`     // max number of requests waiting for inference
+	QueueTimeout int `json:"queueTimeout"` // max time in milliseconds request waits in the queue
+	MaxTimeout   int `json:"maxTimeout"`   // max deadline in milliseconds of requests of the model, zero means no limit
+}
+
+// waiter represents request waiting in model queue
+type waiter struct {
+	ready   chan struct{} // closed once request is granted or shed
+	granted bool          // request got inference slot
+	shed    bool          // request was shed by request with higher priority
+}
+
+// ModelQueue limits concurrent inference of a model and keeps requests
+// waiting for inference
+type ModelQueue struct {
+	Name     string      // model name
+	Limits   Concurrency // concurrency limits
+	inflight int         // number of running inferences
+	queues   map[string]*list.List
+	stats    QueueStats
+	mu       sync.Mutex
+}
+
+// QueueStats represents metrics of model queue
+type QueueStats struct {
+	Model       string         `json:"model"`       // model name
+	MaxInflight int            `json:"maxInflight"` // concurrency limit
+	MaxQueue    int            `json:"maxQueue"`    // queue limit
+	Inflight    int            `json:"inflight"`    // number of running inferences
+	Queued      map[string]int `json:"queued"`      // number of waiting requests per priority class
+	Admitted    int64          `json:"admitted"`    // number of admitted requests
+	Shed        int64          `json:"shed"`        // number of rejected requests
+	Timeouts    int64          `json:"timeouts"`    // number of requests which waited too long or exceeded their deadline
+	Cancelled   int64          `json:"cancelled"`   // number of requests cancelled by their clients while waiting
+	WaitTime    float64        `json:"waitTime"`    // total wait time of admitted requests in seconds
+	MaxWaitTime float64        `json:"maxWaitTime"` // max wait time of admitted request in seconds
+}
+
+// ModelQueues keeps queues of models
+type ModelQueues struct {
+	Queues map[string]*ModelQueue
+	mu     sync.Mutex
+}
+
+// global model queues
+var _queues = ModelQueues{Queues: make(map[string]*ModelQueue)}
+
+// helper function to get concurrency limits of given model
+func modelConcurrency(name string) Concurrency {
+	limits := _config.Concurrency
+	if c, ok := _config.ModelConcurrency[name]; ok {
+		limits = c
+	}
+	if limits.QueueTimeout == 0 {
+		limits.QueueTimeout = 10000
+	}
+	return limits
+}
+
+// get returns queue of given model
+func (q *ModelQueues) get(name string) *ModelQueue {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	mq, ok := q.Queues[name]
+	if !ok {
+		mq = &ModelQueue{
+			Name:   name,
+			Limits: modelConcurrency(name),
+			queues: map[string]*list.List{PriorityInteractive: list.New(), PriorityBatch: list.New()},
+		}
+		q.Queues[name] = mq
+	}
+	return mq
+}
+
+// stats returns metrics of model queues
+func (q *ModelQueues) stats() []QueueStats {
+	q.mu.Lock()
+	var queues []*ModelQueue
+	for _, mq := range q.Queues {
+		queues = append(queues, mq)
+	}
+	q.mu.Unlock()
+	var out []QueueStats
+	for _, mq := range queues {
+		mq.mu.Lock()
+		stats := mq.stats
+		stats.Model = mq.Name
+		stats.MaxInflight = mq.Limits.MaxInflight
+		stats.MaxQueue = mq.Limits.MaxQueue
+		stats.Inflight = mq.inflight
+		stats.Queued = make(map[string]int)
+		for priority, l := range mq.queues {
+			stats.Queued[priority] = l.Len()
+		}
+		mq.mu.Unlock()
+		out = append(out, stats)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Model < out[j].Model })
+	return out
+}
+
+// helper function to get number of queued requests, it should be called
+// with acquired lock
+func (m *ModelQueue) queued() int {
+	return m.queues[PriorityInteractive].Len() + m.queues[PriorityBatch].Len()
+}
+
+// acquire waits for inference slot of the model, it returns release
+// function which should be called once inference is finished
+func (m *ModelQueue) acquire(ctx context.Context, priority string) (func(), error) {
+	if m.Limits.MaxInflight <= 0 {
+		return func() {}, nil
+	}
+	start := time.Now()
+	m.mu.Lock()
+	if m.inflight < m.Limits.MaxInflight && m.queued() == 0 {
+		m.inflight++
+		m.stats.Admitted++
+		m.mu.Unlock()
+		return m.release, nil
+	}
+	if m.queued() >= m.Limits.MaxQueue {
+		// interactive requests take place of the most recent batch request
+		batch := m.queues[PriorityBatch]
+		if priority != PriorityInteractive || batch.Len() == 0 {
+			m.stats.Shed++
+			m.mu.Unlock()
+			return nil, ErrQueueFull
+		}
+		last := batch.Remove(batch.Back()).(*waiter)
+		last.shed = true
+		close(last.ready)
+	}
+	w := &waiter{ready: make(chan struct{})}
+	elem := m.queues[priority].PushBack(w)
+	m.mu.Unlock()
+
+	timer := time.NewTimer(time.Duration(m.Limits.QueueTimeout) * time.Millisecond)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-w.ready:
+	case <-timer.C:
+		err = ErrQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch {
+	case w.granted:
+		// slot could be granted while we were timing out
+		elapsed := time.Since(start).Seconds()
+		m.stats.Admitted++
+		m.stats.WaitTime += elapsed
+		if elapsed > m.stats.MaxWaitTime {
+			m.stats.MaxWaitTime = elapsed
+		}
+		return m.release, nil
+	case w.shed:
+		m.stats.Shed++
+		return nil, ErrQueueFull
+	}
+	m.queues[priority].Remove(elem)
+	if err == ErrQueueTimeout || errors.Is(err, context.DeadlineExceeded) {
+		m.stats.Timeouts++
+	} else {
+		m.stats.Cancelled++
+	}
+	return nil, err
+}
+
+// release passes inference slot to the next waiting request, interactive
+// requests go first
+func (m *ModelQueue) release() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, priority := range []string{PriorityInteractive, PriorityBatch} {
+		l := m.queues[priority]
+		if l.Len() > 0 {
+			w := l.Remove(l.Front()).(*waiter)
+			w.granted = true
+			close(w.ready)
+			return
+		}
+	}
+	m.inflight--
+}
+
+// helper function to get priority class of HTTP request from X-Priority
+// header or priority query parameter
+func requestPriority(r *http.Request) string {
+	priority := r.Header.Get("X-Priority")
+	if priority == "" {
+		priority = r.URL.Query().Get("priority")
+	}
+	if strings.ToLower(priority) == PriorityBatch {
+		return PriorityBatch
+	}
+	return PriorityInteractive
+}
+
+// helper function to acquire inference slots of given models, models are
+// acquired in sorted order to avoid deadlocks, it returns release function
+// or name of the model which is not available
+func acquireModels(ctx context.Context, priority string, models []string) (func(), string, error) {
+	names := append([]string{}, models...)
+	sort.Strings(names)
+	var releases []func()
+	release := func() {
+		for i := len(releases) - 1; i >= 0; i-- {
+			releases[i]()
+		}
+	}
+	for i, name := range names {
+		if i > 0 && name == names[i-1] {
+			continue
+		}
+		// models without limits do not need queues
+		if modelConcurrency(name).MaxInflight <= 0 {
+			continue
+		}
+		rel, err := _queues.get(name).acquire(ctx, priority)
+		if err != nil {
+			release()
+			return nil, name, err
+		}
+		releases = append(releases, rel)
+	}
+	return release, "", nil
+}
+
+// helper function to get models used to make predictions of given model,
+// i.e. the model itself or models of pipeline stages
+func predictionModels(name string) []string {
+	if name == "" {
+		name = _params.Name
+	}
+	if !isPipeline(name) {
+		return []string{name}
+	}
+	p, err := getPipeline(name)
+	if err != nil {
+		return []string{name}
+	}
+	var models []string
+	for _, s := range p.Stages {
+		if s.Model != "" {
+			models = append(models, s.Model)
+		}
+	}
+	return models
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// helper function to atomically exchange two paths, it is not supported
+// on this platform and callers fall back to consecutive renames
+func exchangePaths(src, dst string) error {
+	return errors.New("atomic exchange of paths is not supported")
+}
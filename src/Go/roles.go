@@ -0,0 +1,217 @@
+package main
+
+// roles module provides role based authorization of clients and
+// ownership of models
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// roles of clients, each role includes permissions of preceding roles
+const (
+	RoleReader    = "reader"    // read models, their metadata and web UI
+	RolePredictor = "predictor" // make predictions
+	RoleUploader  = "uploader"  // upload, overwrite and delete own models
+	RoleAdmin     = "admin"     // manage server and all models
+)
+
+// ordered list of roles
+var _roles = []string{RoleReader, RolePredictor, RoleUploader, RoleAdmin}
+
+// helper function to get level of given role, unknown role has no permissions
+func roleLevel(role string) int {
+	for i, r := range _roles {
+		if r == role {
+			return i
+		}
+	}
+	return -1
+}
+
+// Identity represents client of the server
+type Identity struct {
+	Name   string   `json:"name"`   // user DN or token user, empty for anonymous clients
+	Method string   `json:"method"` // authentication method, e.g. x509, apikey, jwt, local or anonymous
+	Groups []string `json:"groups"` // groups of the user
+	Role   string   `json:"role"`   // role of the user
+}
+
+// HasRole checks if identity has permissions of given role
+func (i *Identity) HasRole(role string) bool {
+	return roleLevel(i.Role) >= roleLevel(role) && roleLevel(role) >= 0
+}
+
+// helper function to check if identity is member of given group
+func (i *Identity) member(group string) bool {
+	return InList(group, i.Groups)
+}
+
+// helper function to check if configuration entry refers to the user by its
+// name, entries of admins, roles and groups are certificate DNs and they are
+// never matched against names of token users which are chosen by token issuers
+func (i *Identity) named(entries []string) bool {
+	return i.Method == "x509" && InList(i.Name, entries)
+}
+
+// helper function to assign groups and role to authenticated user, user
+// gets the highest role it is granted by roles configuration either via
+// its DN, its groups or "*" which grants role to any authenticated user
+func (i *Identity) assignRole() {
+	for group, members := range _config.Groups {
+		if i.named(members) && !i.member(group) {
+			i.Groups = append(i.Groups, group)
+		}
+	}
+	i.Role = _config.DefaultRole
+	if i.named(_config.Admins) {
+		i.Role = RoleAdmin
+		return
+	}
+	for role, entries := range _config.Roles {
+		if roleLevel(role) <= roleLevel(i.Role) {
+			continue
+		}
+		for _, entry := range entries {
+			if entry == "*" || i.named([]string{entry}) || (strings.HasPrefix(entry, "group:") && i.member(strings.TrimPrefix(entry, "group:"))) {
+				i.Role = role
+				break
+			}
+		}
+	}
+}
+
+// context key of client identity
+type identityKey struct{}
+
+// helper function to store identity of the client in HTTP request
+func withIdentity(r *http.Request, id Identity) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), identityKey{}, id))
+}
+
+// helper function to get identity of the client of HTTP request
+func requestIdentity(r *http.Request) Identity {
+	if id, ok := r.Context().Value(identityKey{}).(Identity); ok {
+		return id
+	}
+	return Identity{Method: "anonymous"}
+}
+
+// roleMiddleware allows access only to clients with given role
+func roleMiddleware(role string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := requestIdentity(r)
+			if !id.HasRole(role) {
+				msg := fmt.Sprintf("%s role is required", role)
+				code := http.StatusForbidden
+				if id.Method == "anonymous" {
+					code = http.StatusUnauthorized
+				}
+				responseError(w, msg, nil, code)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// helper function to wrap HTTP handler function with role check and with
+// rate limits and quotas of the route group of the role
+func withRole(role string, handler http.HandlerFunc) http.Handler {
+	return roleMiddleware(role)(rateMiddleware(_roleLimits[role])(handler))
+}
+
+// helper function to check if identity may modify model with given
+// parameters, models owned by a group may be modified only by members of
+// that group
+func canModify(id Identity, params TFParams) error {
+	if id.HasRole(RoleAdmin) {
+		return nil
+	}
+	if !id.HasRole(RoleUploader) {
+		return fmt.Errorf("%s role is required", RoleUploader)
+	}
+	if params.Group != "" && !id.member(params.Group) {
+		return fmt.Errorf("model %s is owned by group %s", params.Name, params.Group)
+	}
+	return nil
+}
+
+// helper function to check if identity may overwrite or delete existing model,
+// new models do not have ownership while ownership of broken models is
+// unknown and only admins may modify them
+func authorizeModel(id Identity, name string) error {
+	if _, err := os.Stat(filepath.Join(_config.ModelDir, name)); os.IsNotExist(err) {
+		return nil
+	}
+	params, err := readParams(name)
+	if err != nil {
+		if id.HasRole(RoleAdmin) {
+			return nil
+		}
+		return fmt.Errorf("ownership of model %s is unknown: %v", name, err)
+	}
+	return canModify(id, params)
+}
+
+// helper function to get group owning uploaded model, models which do not
+// declare their group keep group of existing model or they are owned by the
+// first group of the uploader, only admins may upload models without owner
+func ownerGroup(id Identity, name, group string) (string, error) {
+	if group != "" {
+		return group, nil
+	}
+	if params, err := readParams(name); err == nil && params.Group != "" {
+		return params.Group, nil
+	}
+	if len(id.Groups) > 0 {
+		return id.Groups[0], nil
+	}
+	if id.HasRole(RoleAdmin) {
+		return "", nil
+	}
+	return "", fmt.Errorf("model %s does not declare its group and uploader does not belong to any group", name)
+}
+
+// helper function to check if identity may activate bundle models, i.e.
+// overwrite existing models and assign ownership of new models, group of the
+// model is stored in its metadata if model does not declare it
+func (b *Bundle) authorize(id Identity) error {
+	for _, name := range b.Models {
+		if err := authorizeModel(id, name); err != nil {
+			return err
+		}
+		path := filepath.Join(b.Root, name)
+		params, err := readParamsFile(filepath.Join(path, "params.json"))
+		if err != nil {
+			continue
+		}
+		group, err := ownerGroup(id, name, params.Group)
+		if err != nil {
+			return fmt.Errorf("unable to assign ownership: %v", err)
+		}
+		if group != params.Group {
+			meta, _ := readMetadata(path)
+			meta.Group = group
+			if err := writeMetadata(path, meta); err != nil {
+				return err
+			}
+			params.Group = group
+		}
+		// uploaded model should be owned by a group of the uploader
+		if err := canModify(id, params); err != nil {
+			return fmt.Errorf("unable to assign ownership: %v", err)
+		}
+	}
+	return nil
+}
+
+// WhoamiHandler returns identity of the client
+func WhoamiHandler(w http.ResponseWriter, r *http.Request) {
+	responseJSON(w, requestIdentity(r))
+}
@@ -1,12 +1,12 @@
 package main
 
 import (
-	"crypto/tls"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -22,6 +22,7 @@ var Time0 time.Time
 // global variables
 var (
 	_header, _footer, _tmplDir string
+	_headerLock                sync.RWMutex
 )
 
 // Memory contains details about memory information
@@ -52,33 +53,80 @@ func basePath(s string) string {
 	return s
 }
 
+// helper function to render page templates with current list of models
+func refreshModels() {
+	var templates Templates
+	tmplData := make(map[string]interface{})
+	tmplData["Base"] = _config.Base
+	tmplData["Content"] = fmt.Sprintf("Hello from TFaaS")
+	tmplData["Version"] = info()
+	tmplData["Models"], _ = TFModels()
+	header := templates.Header(_tmplDir, tmplData)
+	footer := templates.Footer(_tmplDir, tmplData)
+	_headerLock.Lock()
+	_header = header
+	_footer = footer
+	_headerLock.Unlock()
+}
+
+// helper function to get page header and footer
+func pageTemplates() (string, string) {
+	_headerLock.RLock()
+	defer _headerLock.RUnlock()
+	return _header, _footer
+}
+
 // http handlers
 func handlers() *mux.Router {
 	router := mux.NewRouter()
 
-	// visible routes
-	router.HandleFunc(basePath("/delete"), DeleteHandler).Methods("DELETE")
-	router.HandleFunc(basePath("/delete/{model:[a-zA-Z0-9_]+}"), DeleteHandler).Methods("DELETE")
-	router.HandleFunc(basePath("/upload"), UploadHandler).Methods("POST")
-	router.HandleFunc(basePath("/predict/json"), PredictHandler).Methods("POST")
-	router.HandleFunc(basePath("/predict/proto"), PredictProtobufHandler).Methods("POST")
-	router.HandleFunc(basePath("/predict/image"), ImageHandler).Methods("POST")
-	router.HandleFunc(basePath("/json"), PredictHandler).Methods("POST")
-	router.HandleFunc(basePath("/proto"), PredictProtobufHandler).Methods("POST")
-	router.HandleFunc(basePath("/image"), ImageHandler).Methods("POST")
-	router.HandleFunc(basePath("/params"), ParamsHandler).Methods("POST")
-	router.HandleFunc(basePath("/params/{model:[a-zA-Z0-9_]+}"), ParamsHandler).Methods("GET")
-	router.HandleFunc(basePath("/data"), DataHandler).Methods("GET")
-	router.HandleFunc(basePath("/models"), ModelsHandler).Methods("GET")
-	router.HandleFunc(basePath("/status"), StatusHandler).Methods("GET")
-	router.HandleFunc(basePath("/netron/"), NetronHandler).Methods("GET")
-	router.HandleFunc(basePath("/netron/{.*}"), NetronHandler).Methods("GET")
+	// visible routes, each route requires given role of the client
+	router.Handle(basePath("/delete"), withRole(RoleUploader, DeleteHandler)).Methods("DELETE")
+	router.Handle(basePath("/delete/{model:[a-zA-Z0-9_]+}"), withRole(RoleUploader, DeleteHandler)).Methods("DELETE")
+	router.Handle(basePath("/upload"), withRole(RoleUploader, UploadHandler)).Methods("POST")
+	router.Handle(basePath("/validate"), withRole(RoleUploader, ValidateHandler)).Methods("POST")
+	router.Handle(basePath("/uploads"), withRole(RoleUploader, UploadSessionHandler)).Methods("POST")
+	router.Handle(basePath("/uploads/{id:[0-9a-f]+}"), withRole(RoleUploader, UploadStatusHandler)).Methods("GET", "DELETE")
+	router.Handle(basePath("/uploads/{id:[0-9a-f]+}/{chunk:[0-9]+}"), withRole(RoleUploader, UploadChunkHandler)).Methods("PUT")
+	router.Handle(basePath("/uploads/{id:[0-9a-f]+}/finalize"), withRole(RoleUploader, UploadFinalizeHandler)).Methods("POST")
+	router.Handle(basePath("/imports"), withRole(RoleUploader, ImportHandler)).Methods("GET", "POST")
+	router.Handle(basePath("/imports/{id:[0-9a-f]+}"), withRole(RoleUploader, ImportJobHandler)).Methods("GET")
+	router.Handle(basePath("/predict/json"), withRole(RolePredictor, PredictHandler)).Methods("POST")
+	router.Handle(basePath("/predict/proto"), withRole(RolePredictor, PredictProtobufHandler)).Methods("POST")
+	router.Handle(basePath("/predict/image"), withRole(RolePredictor, ImageHandler)).Methods("POST")
+	router.Handle(basePath("/json"), withRole(RolePredictor, PredictHandler)).Methods("POST")
+	router.Handle(basePath("/proto"), withRole(RolePredictor, PredictProtobufHandler)).Methods("POST")
+	router.Handle(basePath("/image"), withRole(RolePredictor, ImageHandler)).Methods("POST")
+	router.Handle(basePath("/params"), withRole(RoleAdmin, ParamsHandler)).Methods("POST")
+	router.Handle(basePath("/params/{model:[a-zA-Z0-9_]+}"), withRole(RoleReader, ParamsHandler)).Methods("GET")
+	router.Handle(basePath("/data"), withRole(RoleReader, DataHandler)).Methods("GET")
+	router.Handle(basePath("/models"), withRole(RoleReader, ModelsHandler)).Methods("GET")
+	router.Handle(basePath("/models/{model:[a-zA-Z0-9_]+}/evaluation"), withRole(RoleReader, EvaluationHandler)).Methods("GET")
+	router.Handle(basePath("/models/{model:[a-zA-Z0-9_]+}/export"), withRole(RoleReader, ExportHandler)).Methods("GET")
+	router.Handle(basePath("/models/{model:[a-zA-Z0-9_]+}/graph"), withRole(RoleReader, GraphHandler)).Methods("GET")
+	router.Handle(basePath("/models/{model:[a-zA-Z0-9_]+}/ready"), withRole(RoleReader, ModelReadyHandler)).Methods("GET")
+	router.Handle(basePath("/model/{model:[a-zA-Z0-9_]+}"), withRole(RoleReader, ModelPageHandler)).Methods("GET")
+	router.Handle(basePath("/export"), withRole(RoleReader, ExportAllHandler)).Methods("GET")
+	router.Handle(basePath("/pipelines"), withRole(RoleUploader, PipelineHandler)).Methods("POST")
+	router.Handle(basePath("/pipelines/{model:[a-zA-Z0-9_]+}"), withRole(RoleReader, PipelineHandler)).Methods("GET")
+	router.Handle(basePath("/status"), withRole(RoleReader, StatusHandler)).Methods("GET")
+	router.Handle(basePath("/whoami"), withRole(RoleReader, WhoamiHandler)).Methods("GET")
+	router.Handle(basePath("/usage"), withRole(RoleReader, UsageHandler)).Methods("GET")
+	router.Handle(basePath("/netron/"), withRole(RoleReader, NetronHandler)).Methods("GET")
+	router.Handle(basePath("/netron/{.*}"), withRole(RoleReader, NetronHandler)).Methods("GET")
 	router.HandleFunc(basePath("/favicon.ico"), FaviconHandler).Methods("GET")
-	router.HandleFunc(basePath("/"), DefaultHandler).Methods("GET")
+	router.Handle(basePath("/"), withRole(RoleReader, DefaultHandler)).Methods("GET")
+
+	// admin routes
+	admin := router.PathPrefix(basePath("/admin")).Subrouter()
+	admin.HandleFunc("/models", AdminModelsHandler).Methods("GET")
+	admin.HandleFunc("/models/{model:[a-zA-Z0-9_]+}/{action:load|unload|reload}", AdminModelHandler).Methods("POST")
+	admin.HandleFunc("/cache", AdminCacheHandler).Methods("DELETE")
+	admin.HandleFunc("/keys", AdminKeysHandler).Methods("GET", "POST")
+	admin.HandleFunc("/keys/{id:[0-9a-f]+}", AdminKeyHandler).Methods("DELETE")
+	admin.Use(roleMiddleware(RoleAdmin), rateMiddleware(LimitAdmin))
 
 	/* for future use
-	// for all requests perform first auth/authz action
-	router.Use(authMiddleware)
 	// validate all input parameters
 	router.Use(validateMiddleware)
 
@@ -86,6 +134,10 @@ func handlers() *mux.Router {
 
 	// log all requests
 	router.Use(loggingMiddleware)
+	// limit requests of IP addresses before they are authenticated
+	router.Use(ipLimitMiddleware)
+	// perform auth/authz action for all requests and identify the client
+	router.Use(authMiddleware)
 	// use limiter middleware to slow down clients
 	router.Use(limitMiddleware)
 
@@ -112,6 +164,7 @@ func server(config string) {
 		}
 		rl, err := rotatelogs.New(logName)
 		if err == nil {
+			_rotateLogs = rl
 			rotlogs := rotateLogWriter{RotateLogs: rl}
 			log.SetOutput(rotlogs)
 			log.SetFlags(log.LstdFlags | log.Lshortfile)
@@ -129,11 +182,31 @@ func server(config string) {
 	if cacheLimit == 0 {
 		cacheLimit = 10 // default number of models to keep in cache
 	}
-	_cache = TFCache{Models: make(map[string]TFCacheEntry), Limit: cacheLimit}
+	_cache = TFCache{
+		Models: make(map[string]*TFCacheEntry),
+		Limit:  cacheLimit,
+		Memory: _config.CacheMemory * 1024 * 1024,
+	}
+	if _config.IdleTTL > 0 {
+		go unloadIdleModels(time.Duration(_config.IdleTTL) * time.Second)
+	}
+	go cleanupUploads(time.Duration(_config.UploadTTL) * time.Second)
 	VERBOSE = _config.Verbose
 
-	// initialize limiter
-	initLimiter(_config.LimiterPeriod)
+	// initialize rate limits
+	if err := initLimiter(); err != nil {
+		log.Fatal("unable to initialize rate limits ", err)
+	}
+
+	// initialize x509 authentication
+	if err := initAuth(); err != nil {
+		log.Fatal("unable to initialize authentication ", err)
+	}
+
+	// initialize API keys and bearer tokens
+	if err := initTokens(); err != nil {
+		log.Fatal("unable to initialize API keys and tokens ", err)
+	}
 
 	// define our handlers
 	sdir := _config.StaticDir
@@ -155,44 +228,45 @@ func server(config string) {
 			d = _config.ModelDir
 		}
 		log.Printf("static '%s' => '%s'\n", m, http.Dir(d))
-		http.Handle(m, http.StripPrefix(m, http.FileServer(http.Dir(d))))
+		handler := http.StripPrefix(m, http.FileServer(http.Dir(d)))
+		http.Handle(m, authMiddleware(roleMiddleware(RoleReader)(handler)))
 	}
+	// liveness and readiness probes do not require authentication and are not rate limited
+	http.HandleFunc(basePath("/healthz"), HealthzHandler)
+	http.HandleFunc(basePath("/readyz"), ReadyzHandler)
 	http.Handle(basePath("/"), handlers())
 
 	// setup templates
-	var templates Templates
-	tmplData := make(map[string]interface{})
-	tmplData["Base"] = _config.Base
-	tmplData["Content"] = fmt.Sprintf("Hello from TFaaS")
-	tmplData["Version"] = info()
-	tmplData["Models"], _ = TFModels()
-	_header = templates.Header(_tmplDir, tmplData)
-	_footer = templates.Footer(_tmplDir, tmplData)
+	refreshModels()
+
+	// load and warm-up models in background
+	go preloadModels()
+
+	// watch model directory for new, changed and removed models
+	if _config.WatchModels {
+		delay := time.Duration(_config.WatchDelay) * time.Second
+		if _, err := watchModels(delay); err != nil {
+			log.Println("unable to watch model directory", err)
+		}
+	}
 
 	// start web server
 	addr := fmt.Sprintf(":%d", _config.Port)
-	_, e1 := os.Stat(_config.ServerCrt)
-	_, e2 := os.Stat(_config.ServerKey)
-	if e1 == nil && e2 == nil {
-		server := &http.Server{
-			Addr: addr,
-			TLSConfig: &tls.Config{
-				ClientAuth: tls.RequestClientCert,
-			},
-		}
-		if _, err := os.Open(_config.ServerKey); err != nil {
-			log.Println("unable to open server key file", _config.ServerKey, err)
-		}
-		if _, err := os.Open(_config.ServerCrt); err != nil {
-			log.Println("unable to open server cert file", _config.ServerCrt, err)
+	server := newServer(addr)
+	https := _serverCerts.certificateLoaded()
+	if https {
+		tlsConfig, err := serverTLSConfig()
+		if err != nil {
+			log.Fatal("unable to create TLS configuration ", err)
 		}
+		server.TLSConfig = tlsConfig
+		// reload server certificates, client CAs and CRLs without restart
+		go watchCerts()
 		log.Println("starting HTTPs server", addr)
-		err = server.ListenAndServeTLS(_config.ServerCrt, _config.ServerKey)
 	} else {
 		log.Println("starting HTTP server", addr)
-		err = http.ListenAndServe(addr, nil)
 	}
-	if err != nil {
+	if err := serve(server, https); err != nil {
 		log.Fatal(err)
 	}
 }
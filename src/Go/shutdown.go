@@ -0,0 +1,131 @@
+package main
+
+// shutdown module provides HTTP server timeouts and graceful shutdown of the
+// server which drains in-flight and queued requests before exit
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// draining flag is set once server received termination signal, the server
+// is not ready to accept new requests since then
+var _draining int32
+
+// helper function to check if server is draining its requests
+func draining() bool {
+	return atomic.LoadInt32(&_draining) == 1
+}
+
+// helper function to convert number of seconds into duration
+func seconds(value int) time.Duration {
+	return time.Duration(value) * time.Second
+}
+
+// helper function to create HTTP server with configured timeouts, handlers
+// are served by default HTTP mux
+func newServer(addr string) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		ReadTimeout:       seconds(_config.ReadTimeout),
+		ReadHeaderTimeout: seconds(_config.ReadHeaderTimeout),
+		WriteTimeout:      seconds(_config.WriteTimeout),
+		IdleTimeout:       seconds(_config.IdleTimeout),
+	}
+}
+
+// helper function to run HTTP(s) server until it receives SIGTERM or SIGINT,
+// then server is gracefully shut down
+func serve(server *http.Server, https bool) error {
+	errs := make(chan error, 1)
+	go func() {
+		if https {
+			errs <- server.ListenAndServeTLS("", "")
+		} else {
+			errs <- server.ListenAndServe()
+		}
+	}()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case err := <-errs:
+		signal.Stop(sig)
+		return err
+	case s := <-sig:
+		log.Printf("received %v, shutting down the server", s)
+	}
+	// second signal terminates the server immediately
+	signal.Stop(sig)
+	shutdown(server)
+	if err := <-errs; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// helper function to gracefully shut down the server, it marks server as not
+// ready, stops accepting new requests, waits for in-flight and queued requests
+// until the grace period is over, releases models and flushes logs
+func shutdown(server *http.Server) {
+	atomic.StoreInt32(&_draining, 1)
+	if delay := seconds(_config.DrainDelay); delay > 0 {
+		// keep serving until load balancers notice that we are not ready
+		log.Printf("server is not ready, keep serving requests for %v", delay)
+		time.Sleep(delay)
+	}
+	grace := seconds(_config.ShutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	log.Printf("drain in-flight requests, grace period %v", grace)
+	if err := server.Shutdown(ctx); err != nil {
+		log.Println("unable to drain all requests", err)
+		server.Close()
+	}
+	// wait for inferences which keep running after their deadline
+	_cache.drain(ctx)
+	log.Printf("server is stopped, uptime %v", time.Since(Time0))
+	flushLogs()
+}
+
+// drain waits for in-flight requests of cached models until given context is
+// done, removes models from the cache and closes sessions of TF 2.X models,
+// sessions of models which still serve requests are left to the process exit
+// while TF 1.X sessions are closed by their requests
+func (c *TFCache) drain(ctx context.Context) {
+	c.mu.Lock()
+	models := c.Models
+	c.Models = make(map[string]*TFCacheEntry)
+	c.mu.Unlock()
+	for name, entry := range models {
+		done := make(chan struct{})
+		go func(entry *TFCacheEntry) {
+			entry.inflight.Wait()
+			close(done)
+		}(entry)
+		select {
+		case <-done:
+			entry.TFModel.close()
+			log.Println("released model", name)
+		case <-ctx.Done():
+			log.Printf("model %s has %d in-flight requests", name, atomic.LoadInt64(&entry.requests))
+		}
+	}
+}
+
+// helper function to flush and close log files, further messages go to stderr
+func flushLogs() {
+	if _rotateLogs == nil {
+		return
+	}
+	log.SetOutput(os.Stderr)
+	if err := _rotateLogs.Close(); err != nil {
+		log.Println("unable to close log file", err)
+	}
+}
@@ -67,3 +67,12 @@ func (q Templates) Main(tdir string, tmplData map[string]interface{}) string {
 	q.header = parseTmpl(tdir, "main.tmpl", tmplData)
 	return q.header
 }
+
+// Model method for Templates structure
+func (q Templates) Model(tdir string, tmplData map[string]interface{}) string {
+	if q.main != "" {
+		return q.main
+	}
+	q.main = parseTmpl(tdir, "model.tmpl", tmplData)
+	return q.main
+}
@@ -3,25 +3,22 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	tf "github.com/galeone/tensorflow/tensorflow/go"
 	"github.com/galeone/tensorflow/tensorflow/go/op"
-	tg "github.com/galeone/tfgo"
 )
 
-// tfCache represent cache for TF 2.X models
-var tfCache map[string]*tg.Model
-var tfCacheParams map[string]TFParams
-
 // ClassifyResult structure represents result of our TF model classification
 type ClassifyResult struct {
 	Filename string        `json:"filename"`
@@ -47,18 +44,32 @@ func (r *Row) String() string {
 
 // TFParams provides meta-data description of TF model to be used
 type TFParams struct {
-	Name        string   `json:"name"`         // model name
-	Model       string   `json:"model"`        // model file name
-	Labels      string   `json:"labels"`       // model labels file name
-	Op          string   `json:"op"`           // model operation
-	InputName   string   `json:"input_name"`   // model input TF layer name
-	OutputName  string   `json:"output_name"`  // model output TF layer name
-	ImgChannels int64    `json:"img_channels"` // for img models number of img channels, color 3, black-white 1
-	Options     []string `json:"options"`      // model options
-	InputNode   string   `json:"input_node"`   // model input node name
-	OutputNode  string   `json:"output_node"`  // model output node name
-	Description string   `json:"description"`  // model description
-	TimeStamp   string   `json:"timestamp"`    // model timestamp
+	Name        string             `json:"name"`                // model name
+	Model       string             `json:"model"`               // model file name
+	Labels      string             `json:"labels"`              // model labels file name
+	Op          string             `json:"op"`                  // model operation
+	InputName   string             `json:"input_name"`          // model input TF layer name
+	OutputName  string             `json:"output_name"`         // model output TF layer name
+	ImgChannels int64              `json:"img_channels"`        // for img models number of img channels, color 3, black-white 1
+	Options     []string           `json:"options"`             // model options
+	InputNode   string             `json:"input_node"`          // model input node name
+	OutputNode  string             `json:"output_node"`         // model output node name
+	Description string             `json:"description"`         // model description
+	TimeStamp   string             `json:"timestamp"`           // model timestamp
+	Pipeline    string             `json:"pipeline"`            // pipeline definition file name
+	Preload     bool               `json:"preload"`             // load and warm-up model at startup and upload
+	Warmup      string             `json:"warmup"`              // warm-up samples file name
+	Version     string             `json:"version"`             // model version
+	Test        *TestSpec          `json:"test"`                // test dataset and quality gates
+	Owner       string             `json:"owner"`               // model owner
+	Group       string             `json:"group"`               // group owning the model
+	Tags        []string           `json:"tags"`                // model tags
+	Dataset     string             `json:"dataset"`             // training dataset
+	Framework   string             `json:"framework"`           // framework version used to train the model
+	Metrics     map[string]float64 `json:"metrics"`             // model metrics, e.g. accuracy or AUC
+	Created     string             `json:"created"`             // model creation time
+	Uploaded    string             `json:"uploaded"`            // model upload time, set by the server
+	Checksums   map[string]string  `json:"checksums,omitempty"` // SHA-256 digests of model files
 }
 
 // String provides string representation of TFParams
@@ -72,11 +83,38 @@ type TFModel struct {
 	Graph          *tf.Graph
 	Labels         []string
 	SessionOptions *tf.SessionOptions
+	Model          *tf.SavedModel // TF 2.X saved model along with its session
+	Flavor         string         // model flavor, tf1 or tf2
 }
 
 // helper function to load TF graph and labels
 func (m *TFModel) loadModel() error {
-	if m.Graph != nil {
+	if m.Graph != nil || m.Model != nil {
+		return nil
+	}
+	flavor, err := tfVersion(m.Params.Name)
+	if err != nil {
+		return err
+	}
+	m.Flavor = flavor
+	path := fmt.Sprintf("%s/%s", _config.ModelDir, m.Params.Name)
+	// make sure we serve model files which were approved
+	if err := verifyModelArea(path); err != nil {
+		return err
+	}
+	if flavor == "tf2" {
+		if VERBOSE > 0 {
+			log.Println("load to cache", path)
+		}
+		model, err := loadSavedModel(path)
+		if err != nil {
+			return err
+		}
+		m.Model = model
+		if err := m.resolveLayers(); err != nil {
+			m.close()
+			return err
+		}
 		return nil
 	}
 	modelPath := fmt.Sprintf("%s/%s/%s", _config.ModelDir, m.Params.Name, m.Params.Model)
@@ -88,96 +126,506 @@ func (m *TFModel) loadModel() error {
 	if err != nil {
 		return err
 	}
+	input, output, inferred, err := resolveNodes(graph, nil, m.Params, flavor)
+	if err != nil {
+		return err
+	}
+	if inferred != (ModelMetadata{}) {
+		log.Printf("model %s infer input node %s output node %s", m.Params.Name, input, output)
+	}
+	m.Params.InputNode, m.Params.OutputNode = input, output
 	m.Graph = graph
 	m.Labels = labels
 	return nil
 }
 
+// helper function to resolve input and output layers of TF 2.X model,
+// layers which are not declared by model params are default layers of
+// Keras models or they are inferred from the model graph
+func (m *TFModel) resolveLayers() error {
+	input, output := m.Params.InputName, m.Params.OutputName
+	if input == "" {
+		input = DefaultInputName
+	}
+	if output == "" {
+		output = DefaultOutputName
+	}
+	_, ierr := modelOp(m.Model, input)
+	_, oerr := modelOp(m.Model, output)
+	if ierr == nil && oerr == nil {
+		m.Params.InputName, m.Params.OutputName = input, output
+		return nil
+	}
+	// resolve layers from graph and signatures of the loaded model
+	input, output, inferred, err := resolveNodes(m.Model.Graph, m.Model.Signatures, m.Params, "tf2")
+	if err != nil {
+		return err
+	}
+	if inferred != (ModelMetadata{}) {
+		log.Printf("model %s infer input layer %s output layer %s", m.Params.Name, input, output)
+	}
+	m.Params.InputName, m.Params.OutputName = input, output
+	return nil
+}
+
+// helper function to get input and output of the model which were resolved
+// when the model was loaded
+func (m *TFModel) nodes() (tf.Output, tf.Output, error) {
+	var input, output tf.Output
+	if m.Flavor == "tf2" {
+		if m.Model == nil {
+			return input, output, fmt.Errorf("model %s is not TF 2.X model", m.Params.Name)
+		}
+		var err error
+		input, err = modelOp(m.Model, m.Params.InputName)
+		if err != nil {
+			return input, output, &NodeError{Model: m.Params.Name, Param: "input_name", Node: m.Params.InputName}
+		}
+		output, err = modelOp(m.Model, m.Params.OutputName)
+		if err != nil {
+			return input, output, &NodeError{Model: m.Params.Name, Param: "output_name", Node: m.Params.OutputName}
+		}
+		return input, output, nil
+	}
+	if m.Graph == nil {
+		return input, output, fmt.Errorf("model %s is not TF 1.X model", m.Params.Name)
+	}
+	op := m.Graph.Operation(m.Params.InputNode)
+	if op == nil {
+		info := inspectGraph(m.Graph, nil)
+		return input, output, &NodeError{Model: m.Params.Name, Param: "input_node", Node: m.Params.InputNode, Candidates: info.InputCandidates}
+	}
+	input = op.Output(0)
+	op = m.Graph.Operation(m.Params.OutputNode)
+	if op == nil {
+		info := inspectGraph(m.Graph, nil)
+		return input, output, &NodeError{Model: m.Params.Name, Param: "output_node", Node: m.Params.OutputNode, Candidates: info.OutputCandidates}
+	}
+	return input, op.Output(0), nil
+}
+
+// helper function to load TF 2.X model, we keep saved model itself rather
+// than tfgo model since we need its graph and should close its session once
+// the model is released
+func loadSavedModel(path string) (*tf.SavedModel, error) {
+	model, err := tf.LoadSavedModel(path, []string{"serve"}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load %s: %v", path, err)
+	}
+	return model, nil
+}
+
+// helper function to get output of TF 2.X model layer
+func modelOp(model *tf.SavedModel, layer string) (tf.Output, error) {
+	op := model.Graph.Operation(layer)
+	if op == nil {
+		return tf.Output{}, fmt.Errorf("op %s not found", layer)
+	}
+	if op.NumOutputs() == 0 {
+		return tf.Output{}, fmt.Errorf("op %s does not have outputs", layer)
+	}
+	return op.Output(0), nil
+}
+
+// helper function to run TF 2.X model
+func execModel(model *tf.SavedModel, outputs []tf.Output, feeds map[tf.Output]*tf.Tensor) ([]*tf.Tensor, error) {
+	results, err := model.Session.Run(feeds, outputs, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to run model: %v", err)
+	}
+	return results, nil
+}
+
+// close releases TF session of the model, TF Go API does not allow to delete
+// graphs explicitly therefore we drop references to the graph and it is
+// deleted by its finalizer
+func (m *TFModel) close() {
+	if m.Model != nil && m.Model.Session != nil {
+		if err := m.Model.Session.Close(); err != nil {
+			log.Println("unable to close session of", m.Params.Name, err)
+		}
+	}
+	m.Model = nil
+	m.Graph = nil
+}
+
 // TFCacheEntry holds all TFModels
 type TFCacheEntry struct {
-	TFModel TFModel
-	Time    time.Time
+	TFModel  TFModel
+	Time     time.Time       // model load time
+	Size     int64           // size of model area on disk
+	RSS      int64           // RSS delta of the process when model was loaded
+	lastUsed int64           // last time model was used, unix nano time
+	requests int64           // number of in-flight requests using the model
+	hits     int64           // number of requests served by the model
+	inflight *sync.WaitGroup // tracks in-flight requests using the model
 }
 
-// TFCache holds all TFModels
-type TFCache struct {
-	Models map[string]TFCacheEntry
-	Limit  int
+// Memory returns approximate memory used by the model
+func (e *TFCacheEntry) Memory() int64 {
+	if e.RSS > e.Size {
+		return e.RSS
+	}
+	return e.Size
 }
 
-// add TFModel to the cache
-func (c *TFCache) add(name string) error {
-	if _, ok := c.Models[name]; ok {
-		return nil
+// LastUsed returns last time the model was used
+func (e *TFCacheEntry) LastUsed() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&e.lastUsed))
+}
+
+// release closes TF session of the model removed from the cache once its
+// in-flight requests are finished, it should be called after the entry is
+// removed from the cache such that no new requests can acquire it
+func (e *TFCacheEntry) release(name string) {
+	go func() {
+		e.inflight.Wait()
+		e.TFModel.close()
+		log.Println("released model", name)
+	}()
+}
+
+// helper function to create new cache entry for given model
+func newCacheEntry(tfm TFModel, rss int64) *TFCacheEntry {
+	now := time.Now()
+	path := fmt.Sprintf("%s/%s", _config.ModelDir, tfm.Params.Name)
+	size, err := dirSize(path)
+	if err != nil {
+		log.Println("unable to get size of", path, err)
 	}
-	log.Println("load to cache", name)
-	path := fmt.Sprintf("%s/%s", _config.ModelDir, name)
-	fname := fmt.Sprintf("%s/params.json", path)
-	if VERBOSE > 0 {
-		log.Println("add to TFCache", fname)
+	return &TFCacheEntry{
+		TFModel:  tfm,
+		Time:     now,
+		Size:     size,
+		RSS:      rss,
+		lastUsed: now.UnixNano(),
+		inflight: &sync.WaitGroup{},
 	}
+}
+
+// TFCache holds all TFModels
+type TFCache struct {
+	Models  map[string]*TFCacheEntry
+	Limit   int   // max number of models to keep in cache
+	Memory  int64 // memory budget of the cache in bytes, zero means no budget
+	loading map[string]*cacheLoad // models which are being loaded
+	mu      sync.RWMutex
+}
+
+// cacheLoad represents loading of the model shared by concurrent requests
+type cacheLoad struct {
+	done chan struct{} // closed when the model is loaded
+	err  error         // load error
+}
+
+// helper function to read model parameters from model area
+func readParams(name string) (TFParams, error) {
+	return readParamsFile(fmt.Sprintf("%s/%s/params.json", _config.ModelDir, name))
+}
+
+// helper function to read model parameters from given file
+func readParamsFile(fname string) (TFParams, error) {
+	var params TFParams
 	file, err := os.Open(fname)
-	defer file.Close()
 	if err != nil {
-		return err
+		return params, err
 	}
-	var params TFParams
+	defer file.Close()
 	if err := json.NewDecoder(file).Decode(&params); err != nil {
-		return err
+		return params, err
 	}
-	if params.TimeStamp == "" {
-		params.TimeStamp = time.Now().String()
+	setMetadata(&params, fname)
+	return params, nil
+}
+
+// helper function to load TFModel for given model name
+func newTFModel(name string) (TFModel, error) {
+	params, err := readParams(name)
+	if err != nil {
+		return TFModel{}, err
 	}
 	if VERBOSE > 0 {
 		log.Println("add to TFCache", params)
 	}
 	tfm := TFModel{Params: params}
-	err = tfm.loadModel()
-	if err == nil {
-		c.Models[params.Name] = TFCacheEntry{TFModel: tfm, Time: time.Now()}
-	} else {
-		log.Println("unable to load TF model", err)
+	if err := tfm.loadModel(); err != nil {
+		return tfm, err
+	}
+	// model should be warmed up before we mark it as ready
+	if err := warmUp(&tfm); err != nil {
+		tfm.close()
+		return tfm, err
+	}
+	return tfm, nil
+}
 
+// helper function to load TFModel and measure RSS delta of the process
+func loadTFModel(name string) (TFModel, int64, error) {
+	rss0 := processRSS()
+	tfm, err := newTFModel(name)
+	if err != nil {
+		return tfm, 0, err
 	}
-	if VERBOSE > 0 {
-		log.Println("add to TFCache", c)
+	rss := processRSS() - rss0
+	if rss < 0 {
+		rss = 0
+	}
+	return tfm, rss, nil
+}
+
+// add TFModel to the cache, concurrent requests of the model which is not
+// in the cache wait for single load of the model
+func (c *TFCache) add(name string) error {
+	c.mu.Lock()
+	if _, ok := c.Models[name]; ok {
+		c.mu.Unlock()
+		return nil
+	}
+	if load, ok := c.loading[name]; ok {
+		c.mu.Unlock()
+		<-load.done
+		return load.err
+	}
+	if c.loading == nil {
+		c.loading = make(map[string]*cacheLoad)
+	}
+	load := &cacheLoad{done: make(chan struct{})}
+	c.loading[name] = load
+	c.mu.Unlock()
+
+	log.Println("load to cache", name)
+	tfm, rss, err := loadTFModel(name)
+	c.mu.Lock()
+	delete(c.loading, name)
+	if err != nil {
+		log.Println("unable to load TF model", err)
+	} else {
+		c.Models[name] = newCacheEntry(tfm, rss)
+		c.evict(name)
+		if VERBOSE > 0 {
+			log.Println("add to TFCache", name)
+		}
 	}
+	c.mu.Unlock()
+	load.err = err
+	close(load.done)
 	return err
 }
 
+// helper function to get total memory used by the cache,
+// it should be called with acquired lock
+func (c *TFCache) usedMemory() int64 {
+	var total int64
+	for _, entry := range c.Models {
+		total += entry.Memory()
+	}
+	return total
+}
+
+// evict least recently used models (except given one and pinned models) from
+// the cache until it fits its size limit and memory budget, it should be
+// called with acquired lock
+func (c *TFCache) evict(keep string) {
+	for {
+		overLimit := len(c.Models) > c.Limit
+		overBudget := c.Memory > 0 && c.usedMemory() > c.Memory
+		if !overLimit && !overBudget {
+			return
+		}
+		var lruName string
+		var lruTime time.Time
+		for name, entry := range c.Models {
+			if name == keep || isPinned(entry.TFModel.Params) {
+				continue
+			}
+			if lruName == "" || entry.LastUsed().Before(lruTime) {
+				lruName = name
+				lruTime = entry.LastUsed()
+			}
+		}
+		if lruName == "" {
+			if overBudget {
+				log.Printf("model %s and pinned models exceed cache memory budget of %d bytes", keep, c.Memory)
+			} else {
+				log.Printf("model %s and pinned models exceed cache limit of %d models", keep, c.Limit)
+			}
+			return
+		}
+		log.Println("evict from cache", lruName)
+		c.Models[lruName].release(lruName)
+		delete(c.Models, lruName)
+	}
+}
+
+// reload loads new version of the model and atomically swaps it in the
+// cache, the old version is released once its in-flight requests are finished
+func (c *TFCache) reload(name string) error {
+	c.mu.RLock()
+	_, ok := c.Models[name]
+	c.mu.RUnlock()
+	if !ok {
+		// model is not loaded yet, it will be loaded on demand
+		return nil
+	}
+	tfm, rss, err := loadTFModel(name)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	old, ok := c.Models[name]
+	c.Models[name] = newCacheEntry(tfm, rss)
+	c.evict(name)
+	c.mu.Unlock()
+	if ok {
+		old.release(name)
+	}
+	return nil
+}
+
+// loaded checks if given model is loaded into the cache
+func (c *TFCache) loaded(name string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	_, ok := c.Models[name]
+	return ok
+}
+
 // remove given model from the cache
 func (c *TFCache) remove(name string) {
-	delete(c.Models, name)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry, ok := c.Models[name]; ok {
+		entry.release(name)
+		delete(c.Models, name)
+	}
+}
+
+// unloadIdle removes from the cache models which were not used during
+// given time-to-live interval, preloaded and required models are kept in the cache
+func (c *TFCache) unloadIdle(ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name, entry := range c.Models {
+		if isPinned(entry.TFModel.Params) {
+			continue
+		}
+		if atomic.LoadInt64(&entry.requests) > 0 {
+			continue
+		}
+		if time.Since(entry.LastUsed()) > ttl {
+			log.Printf("unload idle model %s, last used %v", name, entry.LastUsed())
+			entry.release(name)
+			delete(c.Models, name)
+		}
+	}
+}
+
+// helper function to periodically unload idle models from the cache
+func unloadIdleModels(ttl time.Duration) {
+	interval := ttl / 2
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	for {
+		time.Sleep(interval)
+		_cache.unloadIdle(ttl)
+	}
 }
 
 // return TFModel from the cache
 func (c *TFCache) get(name string) (TFModel, error) {
-	if entry, ok := c.Models[name]; ok {
-		return entry.TFModel, nil
+	tfm, release, err := c.acquire(name)
+	if err != nil {
+		return tfm, err
 	}
-	// our model is not available yet in cache
-	// check cache size and clean it up if necessary
-	if len(c.Models) >= c.Limit {
-		var oldestName string
-		oldestTime := time.Now()
-		for name, entry := range c.Models {
-			if entry.Time.Unix() < oldestTime.Unix() {
-				oldestName = name
-				oldestTime = entry.Time
-			}
+	release()
+	return tfm, nil
+}
+
+// acquire returns TFModel from the cache along with release function which
+// should be called once caller finished with the model
+func (c *TFCache) acquire(name string) (TFModel, func(), error) {
+	c.mu.RLock()
+	entry, ok := c.Models[name]
+	if ok {
+		entry.inflight.Add(1)
+		atomic.AddInt64(&entry.requests, 1)
+		atomic.AddInt64(&entry.hits, 1)
+		atomic.StoreInt64(&entry.lastUsed, time.Now().UnixNano())
+	}
+	c.mu.RUnlock()
+	if ok {
+		release := func() {
+			atomic.AddInt64(&entry.requests, -1)
+			entry.inflight.Done()
 		}
-		delete(c.Models, oldestName)
+		return entry.TFModel, release, nil
 	}
-	// add new model into cache
-	err := c.add(name)
-	if err != nil {
-		return TFModel{}, err
+	// our model is not available yet in cache, add it to the cache
+	if err := c.add(name); err != nil {
+		return TFModel{}, nil, err
 	}
-	// return model from the cache
-	entry, _ := c.Models[name]
-	return entry.TFModel, nil
+	return c.acquire(name)
 }
 
+// flush removes all models from the cache
+func (c *TFCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name, entry := range c.Models {
+		entry.release(name)
+	}
+	c.Models = make(map[string]*TFCacheEntry)
+}
+
+// CacheRecord represents information about model loaded into the cache
+type CacheRecord struct {
+	Name     string    `json:"name"`     // model name
+	Version  string    `json:"version"`  // model version
+	Flavor   string    `json:"flavor"`   // model flavor
+	Size     int64     `json:"size"`     // size of model area on disk
+	RSS      int64     `json:"rss"`      // RSS delta when model was loaded
+	Memory   int64     `json:"memory"`   // approximate memory used by the model
+	Loaded   time.Time `json:"loaded"`   // model load time
+	LastUsed time.Time `json:"lastUsed"` // last time model was used
+	Requests int64     `json:"requests"` // number of in-flight requests
+	Hits     int64     `json:"hits"`     // number of requests served by the model
+}
+
+// records returns information about models loaded into the cache
+func (c *TFCache) records() []CacheRecord {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var out []CacheRecord
+	for name, entry := range c.Models {
+		version := entry.TFModel.Params.Version
+		if version == "" {
+			version = entry.TFModel.Params.TimeStamp
+		}
+		rec := CacheRecord{
+			Name:     name,
+			Version:  version,
+			Flavor:   entry.TFModel.Flavor,
+			Size:     entry.Size,
+			RSS:      entry.RSS,
+			Memory:   entry.Memory(),
+			Loaded:   entry.Time,
+			LastUsed: entry.LastUsed(),
+			Requests: atomic.LoadInt64(&entry.requests),
+			Hits:     atomic.LoadInt64(&entry.hits),
+		}
+		out = append(out, rec)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// default input and output layer names of Keras models saved as TF 2.X SavedModel
+const (
+	DefaultInputName  = "serving_default_inputs_input"
+	DefaultOutputName = "StatefulPartitionedCall"
+)
+
 // global variables
 var (
 	_cache          TFCache            // local cache for TFModels
@@ -214,28 +662,39 @@ func loadModel(fname, flabels string) (*tf.Graph, []string, error) {
 		return graph, labels, err
 	}
 	// Load labels
-	labelsFile, err := os.Open(flabels)
+	labels, err = readLabels(flabels)
 	if err != nil {
 		return graph, labels, err
 	}
+	log.Println("load TF model", fname, flabels)
+	return graph, labels, nil
+}
+
+// helper function to read model labels
+func readLabels(flabels string) ([]string, error) {
+	var labels []string
+	labelsFile, err := os.Open(flabels)
+	if err != nil {
+		return labels, err
+	}
 	defer labelsFile.Close()
 	scanner := bufio.NewScanner(labelsFile)
 	// Labels are separated by newlines
 	for scanner.Scan() {
 		labels = append(labels, scanner.Text())
 	}
-	if err := scanner.Err(); err != nil {
-		return graph, labels, err
-	}
-	log.Println("load TF model", fname, flabels)
-	return graph, labels, nil
+	return labels, scanner.Err()
 }
 
 // helper function to determine which model in our repository for given model name
 func tfVersion(name string) (string, error) {
+	return modelFlavor(fmt.Sprintf("%s/%s", _config.ModelDir, name))
+}
+
+// helper function to determine flavor of the model in given model area
+func modelFlavor(path string) (string, error) {
 	// if model area has assets, variables and saved_model.pb
-	// we will use TF 2.X approach based on tfgo
-	path := fmt.Sprintf("%s/%s", _config.ModelDir, name)
+	// we will use TF 2.X approach based on saved models
 	files, err := ioutil.ReadDir(path)
 	if err != nil {
 		return "", err
@@ -244,15 +703,73 @@ func tfVersion(name string) (string, error) {
 	for _, file := range files {
 		fnames = append(fnames, file.Name())
 	}
+	if InList(PipelineFile, fnames) {
+		return "pipeline", nil
+	}
 	if InList("assets", fnames) && InList("variables", fnames) && InList("saved_model.pb", fnames) {
 		return "tf2", nil
 	}
 	return "tf1", nil
 }
 
+// helper function to check that model area contains valid model
+func checkModel(name string) error {
+	_, _, err := checkModelArea(fmt.Sprintf("%s/%s", _config.ModelDir, name), name)
+	return err
+}
+
+// helper function to check that given model area contains valid model
+// with given name, it returns model parameters and model flavor
+func checkModelArea(path, name string) (TFParams, string, error) {
+	params, err := readParamsFile(fmt.Sprintf("%s/params.json", path))
+	if err != nil {
+		return params, "", err
+	}
+	if params.Name != name {
+		return params, "", fmt.Errorf("mismatch of model area %s and TFParams.Name=%s", name, params.Name)
+	}
+	if params.Warmup != "" && !validFileName(params.Warmup) {
+		return params, "", fmt.Errorf("model %s params refer to invalid warm-up file %s", name, params.Warmup)
+	}
+	flavor, err := modelFlavor(path)
+	if err != nil {
+		return params, flavor, err
+	}
+	var files []string
+	switch flavor {
+	case "pipeline":
+		p, err := readPipeline(fmt.Sprintf("%s/%s", path, PipelineFile))
+		if err != nil {
+			return params, flavor, err
+		}
+		if p.Name != name {
+			return params, flavor, fmt.Errorf("mismatch of model area %s and Pipeline.Name=%s", name, p.Name)
+		}
+		_, err = p.Validate()
+		return params, flavor, err
+	case "tf1":
+		files = []string{params.Model, params.Labels}
+	}
+	for _, f := range files {
+		if f == "" {
+			return params, flavor, fmt.Errorf("model %s params do not provide model or labels file", name)
+		}
+		if !filepath.IsLocal(f) {
+			return params, flavor, fmt.Errorf("model %s params refer to file %s outside of model area", name, f)
+		}
+		if _, err := os.Stat(fmt.Sprintf("%s/%s", path, f)); err != nil {
+			return params, flavor, err
+		}
+	}
+	return params, flavor, nil
+}
+
 // helper function to generate predictions based on given row values
-// either TF 2.X models via tfgo or TF 1.X models via graph loading
-func makePredictions(row *Row) ([]float32, error) {
+// either TF 2.X models via saved models, TF 1.X models via graph loading or
+// multi-stage pipelines, given context allows to cancel remaining pipeline
+// stages only, TF sessions can't be interrupted and they run to completion,
+// i.e. request deadline bounds waiting for predictions but not their compute
+func makePredictions(ctx context.Context, row *Row) ([]float32, error) {
 	name := _params.Name
 	if row.Model != "" {
 		name = row.Model
@@ -261,93 +778,47 @@ func makePredictions(row *Row) ([]float32, error) {
 	if err != nil {
 		return []float32{}, err
 	}
+	if tfModel == "pipeline" {
+		res, err := makePipelinePredictions(ctx, name, row)
+		return res.Predictions, err
+	}
 	if tfModel == "tf2" {
 		return makePredictions2(row)
 	}
 	return makePredictions1(row)
 }
 
-// helper function to read tg.Model and its parameters
-func getModel(name string) (*tg.Model, error) {
-	if tfCache == nil {
-		tfCache = make(map[string]*tg.Model)
-	}
-	var model *tg.Model
-	var ok bool
-	model, ok = tfCache[name]
-	if !ok {
-		path := fmt.Sprintf("%s/%s", _config.ModelDir, name)
-		model = tg.LoadModel(path, []string{"serve"}, nil)
-		tfCache[name] = model
-	}
-	return model, nil
-}
-
 // helper function to read model parameters
 func getModelParams(name string) (TFParams, error) {
-	if tfCacheParams == nil {
-		tfCacheParams = make(map[string]TFParams)
-	}
-	params, ok := tfCacheParams[name]
-	if !ok {
-		fname := fmt.Sprintf("%s/%s/params.json", _config.ModelDir, name)
-		file, err := os.Open(fname)
-		if err != nil {
-			return params, err
-		}
-		defer file.Close()
-		data, err := io.ReadAll(file)
-		if err != nil {
-			return params, err
-		}
-
-		err = json.Unmarshal(data, &params)
-		if err != nil {
-			return params, err
-		}
-		tfCacheParams[name] = params
-	}
-	return params, nil
+	return readParams(name)
 }
 
 // helper function to generate predictions based on given row values
-// based on tfgo
+// based on TF 2.X saved models
 func makePredictionsTensor(name string, tensor *tf.Tensor) ([]float32, error) {
 	// our input is a tf Tensor
 
 	// load TF model, saved as keras with the following dir structure
 	// assets saved_model.pb variables
-
 	// look-up model from out cache
-	if tfCache == nil {
-		tfCache = make(map[string]*tg.Model)
-		tfCacheParams = make(map[string]TFParams)
-	}
-
-	// load model parameters
-	model, err := getModel(name)
+	tfm, release, err := _cache.acquire(name)
 	if err != nil {
 		return []float32{}, err
 	}
-	params, err := getModelParams(name)
+	defer release()
+	if tfm.Model == nil {
+		return []float32{}, fmt.Errorf("model %s is not TF 2.X model", name)
+	}
+	input, output, err := tfm.nodes()
 	if err != nil {
 		return []float32{}, err
 	}
-	if params.InputName == "" {
-		msg := fmt.Sprintf("Model params does not contain model input name")
-		return []float32{}, errors.New(msg)
-	}
-	if params.OutputName == "" {
-		msg := fmt.Sprintf("Model params does not contain model output name")
-		return []float32{}, errors.New(msg)
-	}
-	log.Printf("model input %s output %s tensor %v", params.InputName, params.OutputName, tensor)
+	log.Printf("model input %s output %s tensor %v", tfm.Params.InputName, tfm.Params.OutputName, tensor)
 
-	results := model.Exec([]tf.Output{
-		model.Op(params.OutputName, 0),
-	}, map[tf.Output]*tf.Tensor{
-		model.Op(params.InputName, 0): tensor,
-	})
+	results, err := execModel(tfm.Model, []tf.Output{output}, map[tf.Output]*tf.Tensor{input: tensor})
+	if err != nil {
+		return []float32{}, err
+	}
 	probs := results[0]
 	value := probs.Value() // returns [][]float32 vector
 	vals := value.([][]float32)
@@ -355,16 +826,8 @@ func makePredictionsTensor(name string, tensor *tf.Tensor) ([]float32, error) {
 }
 
 // helper function to generate predictions based on given row values
-// based on tfgo
+// based on TF 2.X saved models
 func makePredictions2(row *Row) ([]float32, error) {
-	// our input is a vector, we wrap it into matrix ([ [1,1,...], [], ...])
-	matrix := [][]float32{row.Values}
-	// create tensor vector for our computations
-	tensor, err := tf.NewTensor(matrix)
-	if err != nil {
-		return nil, err
-	}
-
 	// load TF model, saved as keras with the following dir structure
 	// assets saved_model.pb variables
 	name := _params.Name
@@ -372,63 +835,78 @@ func makePredictions2(row *Row) ([]float32, error) {
 		name = row.Model
 	}
 	// look-up model from out cache
-	if tfCache == nil {
-		tfCache = make(map[string]*tg.Model)
+	tfm, release, err := _cache.acquire(name)
+	if err != nil {
+		return nil, err
 	}
-	var model *tg.Model
-	var ok bool
-	model, ok = tfCache[name]
-	if !ok {
-		path := fmt.Sprintf("%s/%s", _config.ModelDir, name)
-		model = tg.LoadModel(path, []string{"serve"}, nil)
-		tfCache[name] = model
-	}
-
-	//     path := fmt.Sprintf("%s/%s", _config.ModelDir, name)
-	//     model := tg.LoadModel(path, []string{"serve"}, nil)
-	results := model.Exec([]tf.Output{
-		model.Op("StatefulPartitionedCall", 0),
-	}, map[tf.Output]*tf.Tensor{
-		model.Op("serving_default_inputs_input", 0): tensor,
-	})
-	probs := results[0]
-	value := probs.Value() // returns [][]float32 vector
-	vals := value.([][]float32)
-	return vals[0], nil
+	defer release()
+	return tfm.predict(row.Values)
 }
 
 // helper function to generate predictions based on given row values
 // based on TF 1.X models
-// influenced by: https://pgaleone.eu/tensorflow/go/2017/05/29/understanding-tensorflow-using-go/
 func makePredictions1(row *Row) ([]float32, error) {
+	// load TF model
+	model := _params.Name
+	if row.Model != "" {
+		model = row.Model
+	}
+	tfm, release, err := _cache.acquire(model)
+	if err != nil {
+		log.Println("unable to get model from cache", model, err)
+		return nil, err
+	}
+	defer release()
+	return tfm.predict(row.Values)
+}
+
+// helper function to generate predictions for given values
+func (m *TFModel) predict(values []float32) ([]float32, error) {
 	// our input is a vector, we wrap it into matrix ([ [1,1,...], [], ...])
-	matrix := [][]float32{row.Values}
+	matrix := [][]float32{values}
 	// create tensor vector for our computations
 	tensor, err := tf.NewTensor(matrix)
 	if err != nil {
 		return nil, err
 	}
+	if m.Flavor == "tf2" {
+		return m.predict2(tensor)
+	}
+	return m.predict1(tensor)
+}
 
-	// load TF model
-	model := _params.Name
-	if row.Model != "" {
-		model = row.Model
+// helper function to generate predictions for given tensor based on TF 2.X saved models
+func (m *TFModel) predict2(tensor *tf.Tensor) ([]float32, error) {
+	input, output, err := m.nodes()
+	if err != nil {
+		return nil, err
 	}
-	tfm, err := _cache.get(model)
+	results, err := execModel(m.Model, []tf.Output{output}, map[tf.Output]*tf.Tensor{input: tensor})
 	if err != nil {
-		log.Println("unable to get model from cache", model, err)
 		return nil, err
 	}
+	probs := results[0]
+	value := probs.Value() // returns [][]float32 vector
+	vals := value.([][]float32)
+	return vals[0], nil
+}
 
+// helper function to generate predictions for given tensor based on TF 1.X models
+// influenced by: https://pgaleone.eu/tensorflow/go/2017/05/29/understanding-tensorflow-using-go/
+func (m *TFModel) predict1(tensor *tf.Tensor) ([]float32, error) {
+	input, output, err := m.nodes()
+	if err != nil {
+		return nil, err
+	}
 	// Run inference with existing graph which we get from loadModel call
-	session, err := tf.NewSession(tfm.Graph, _sessionOptions)
+	session, err := tf.NewSession(m.Graph, _sessionOptions)
 	if err != nil {
 		return nil, err
 	}
 	defer session.Close()
 	results, err := session.Run(
-		map[tf.Output]*tf.Tensor{tfm.Graph.Operation(tfm.Params.InputNode).Output(0): tensor},
-		[]tf.Output{tfm.Graph.Operation(tfm.Params.OutputNode).Output(0)},
+		map[tf.Output]*tf.Tensor{input: tensor},
+		[]tf.Output{output},
 		nil)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,558 @@
+package main
+
+// tokens module provides API keys and JWT bearer token authentication
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// APIKeyPrefix defines prefix of API keys issued by the server
+const APIKeyPrefix = "tfaas"
+
+// allowed clock skew when we validate JWT time claims
+const jwtLeeway = time.Minute
+
+// APIKey represents API key issued by admin, only hash of the key is kept
+type APIKey struct {
+	ID      string   `json:"id"`                // key identifier
+	Name    string   `json:"name"`              // name of the user or service using the key
+	Groups  []string `json:"groups"`            // groups of the user
+	Role    string   `json:"role"`              // role granted by the key
+	Hash    string   `json:"hash,omitempty"`    // SHA-256 of key secret
+	Creator string   `json:"creator"`           // admin who issued the key
+	Created string   `json:"created"`           // key creation time
+	Expires string   `json:"expires,omitempty"` // key expiration time, empty if key does not expire
+}
+
+// APIKeyRequest represents request to issue new API key
+type APIKeyRequest struct {
+	Name   string   `json:"name"`   // name of the user or service using the key
+	Groups []string `json:"groups"` // groups of the user
+	Role   string   `json:"role"`   // role granted by the key, predictor by default
+	TTL    int64    `json:"ttl"`    // key lifetime in seconds, zero means no expiration
+}
+
+// APIKeys keeps API keys issued by the server in a file
+type APIKeys struct {
+	File string            // file with hashes of API keys
+	Keys map[string]APIKey // API keys
+	mu   sync.RWMutex
+}
+
+// global API keys
+var _apiKeys APIKeys
+
+// helper function to load API keys from their file
+func (k *APIKeys) load() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.Keys = make(map[string]APIKey)
+	data, err := ioutil.ReadFile(k.File)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var keys []APIKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		k.Keys[key.ID] = key
+	}
+	return nil
+}
+
+// helper function to store API keys in their file, it should be called with
+// acquired lock
+func (k *APIKeys) save() error {
+	keys := []APIKey{}
+	for _, key := range k.Keys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Created < keys[j].Created })
+	data, err := json.MarshalIndent(keys, "", "    ")
+	if err != nil {
+		return err
+	}
+	// write keys atomically since the file is our only copy of them
+	tmp := k.File + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, k.File)
+}
+
+// helper function to compute hash of API key secret
+func keyHash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// issue creates new API key, the key itself is returned only once
+func (k *APIKeys) issue(req APIKeyRequest, creator string) (APIKey, string, error) {
+	var key APIKey
+	if k.File == "" {
+		return key, "", errors.New("API keys are not configured")
+	}
+	if req.Name == "" {
+		return key, "", errors.New("API key requires name of its user")
+	}
+	if req.Role == "" {
+		req.Role = RolePredictor
+	}
+	if roleLevel(req.Role) < 0 {
+		return key, "", fmt.Errorf("unknown role %s, supported roles: %v", req.Role, _roles)
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return key, "", err
+	}
+	now := time.Now()
+	key = APIKey{
+		ID:      randomID(),
+		Name:    req.Name,
+		Groups:  req.Groups,
+		Role:    req.Role,
+		Hash:    keyHash(hex.EncodeToString(secret)),
+		Creator: creator,
+		Created: now.Format(time.RFC3339),
+	}
+	if req.TTL > 0 {
+		key.Expires = now.Add(time.Duration(req.TTL) * time.Second).Format(time.RFC3339)
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.Keys[key.ID] = key
+	if err := k.save(); err != nil {
+		delete(k.Keys, key.ID)
+		return key, "", err
+	}
+	token := fmt.Sprintf("%s_%s_%s", APIKeyPrefix, key.ID, hex.EncodeToString(secret))
+	key.Hash = ""
+	return key, token, nil
+}
+
+// revoke removes API key with given identifier
+func (k *APIKeys) revoke(id string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	key, ok := k.Keys[id]
+	if !ok {
+		return fmt.Errorf("unknown API key %s", id)
+	}
+	delete(k.Keys, id)
+	if err := k.save(); err != nil {
+		k.Keys[id] = key
+		return err
+	}
+	return nil
+}
+
+// list returns issued API keys without their hashes
+func (k *APIKeys) list() []APIKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	keys := []APIKey{}
+	for _, key := range k.Keys {
+		key.Hash = ""
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Created < keys[j].Created })
+	return keys
+}
+
+// lookup finds valid API key for given token
+func (k *APIKeys) lookup(token string) (APIKey, error) {
+	parts := strings.SplitN(token, "_", 3)
+	if len(parts) != 3 || parts[0] != APIKeyPrefix {
+		return APIKey{}, errors.New("malformed API key")
+	}
+	k.mu.RLock()
+	key, ok := k.Keys[parts[1]]
+	k.mu.RUnlock()
+	if !ok || subtle.ConstantTimeCompare([]byte(key.Hash), []byte(keyHash(parts[2]))) != 1 {
+		return APIKey{}, errors.New("invalid API key")
+	}
+	if key.Expires != "" {
+		expires, err := time.Parse(time.RFC3339, key.Expires)
+		if err != nil || time.Now().After(expires) {
+			return APIKey{}, errors.New("API key is expired")
+		}
+	}
+	return key, nil
+}
+
+// helper function to get API key or bearer token of HTTP request
+func bearerToken(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// helper function to get identity of the client from API key or JWT token
+func tokenIdentity(token string) (Identity, error) {
+	if strings.HasPrefix(token, APIKeyPrefix+"_") {
+		key, err := _apiKeys.lookup(token)
+		if err != nil {
+			return Identity{}, err
+		}
+		return Identity{Name: key.Name, Method: "apikey", Groups: key.Groups, Role: key.Role}, nil
+	}
+	claims, err := verifyJWT(token)
+	if err != nil {
+		return Identity{}, err
+	}
+	id := Identity{Method: "jwt"}
+	id.Name, _ = claims[_config.JWTUserClaim].(string)
+	if id.Name == "" {
+		return id, fmt.Errorf("token does not provide %s claim", _config.JWTUserClaim)
+	}
+	if groups, ok := claims[_config.JWTGroupsClaim].([]interface{}); ok {
+		for _, g := range groups {
+			if group, ok := g.(string); ok {
+				id.Groups = append(id.Groups, group)
+			}
+		}
+	}
+	id.assignRole()
+	return id, nil
+}
+
+// JWK represents JSON web key, see RFC 7517
+type JWK struct {
+	Kty string `json:"kty"` // key type: RSA, EC, OKP or oct
+	Kid string `json:"kid"` // key identifier
+	Alg string `json:"alg"` // key algorithm
+	N   string `json:"n"`   // RSA modulus
+	E   string `json:"e"`   // RSA exponent
+	Crv string `json:"crv"` // curve of EC and OKP keys
+	X   string `json:"x"`   // x coordinate of EC key or OKP public key
+	Y   string `json:"y"`   // y coordinate of EC key
+	K   string `json:"k"`   // symmetric key
+}
+
+// JWTKey represents key used to verify JWT tokens
+type JWTKey struct {
+	Kid string      // key identifier
+	Key interface{} // *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey or []byte
+}
+
+// keys used to verify JWT tokens
+var _jwtKeys []JWTKey
+
+// helper function to decode base64url encoded value
+func b64decode(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// helper function to parse JSON web key
+func parseJWK(jwk JWK) (interface{}, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := b64decode(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64decode(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", jwk.Crv)
+		}
+		x, err := b64decode(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := b64decode(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		if jwk.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %s", jwk.Crv)
+		}
+		x, err := b64decode(jwk.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	case "oct":
+		return b64decode(jwk.K)
+	}
+	return nil, fmt.Errorf("unsupported key type %s", jwk.Kty)
+}
+
+// helper function to load keys used to verify JWT tokens from JWKS file
+// and/or file with shared secret
+func loadJWTKeys(jwksFile, secretFile string) ([]JWTKey, error) {
+	var keys []JWTKey
+	if jwksFile != "" {
+		data, err := ioutil.ReadFile(jwksFile)
+		if err != nil {
+			return nil, err
+		}
+		var jwks struct {
+			Keys []JWK `json:"keys"`
+		}
+		if err := json.Unmarshal(data, &jwks); err != nil {
+			return nil, err
+		}
+		for _, jwk := range jwks.Keys {
+			key, err := parseJWK(jwk)
+			if err != nil {
+				return nil, fmt.Errorf("key %s: %v", jwk.Kid, err)
+			}
+			keys = append(keys, JWTKey{Kid: jwk.Kid, Key: key})
+		}
+	}
+	if secretFile != "" {
+		data, err := ioutil.ReadFile(secretFile)
+		if err != nil {
+			return nil, err
+		}
+		secret := bytes.TrimSpace(data)
+		if len(secret) == 0 {
+			return nil, fmt.Errorf("%s does not contain secret", secretFile)
+		}
+		keys = append(keys, JWTKey{Key: secret})
+	}
+	return keys, nil
+}
+
+// helper function to get hash function of JWT algorithm
+func jwtHash(alg string) (crypto.Hash, func() hash.Hash) {
+	switch alg[2:] {
+	case "384":
+		return crypto.SHA384, sha512.New384
+	case "512":
+		return crypto.SHA512, sha512.New
+	}
+	return crypto.SHA256, sha256.New
+}
+
+// helper function to verify JWT signature with given key
+func verifySignatureJWT(alg string, key interface{}, input, sig []byte) bool {
+	if alg == "EdDSA" {
+		pub, ok := key.(ed25519.PublicKey)
+		return ok && ed25519.Verify(pub, input, sig)
+	}
+	if len(alg) != 5 {
+		return false
+	}
+	hashID, hashFunc := jwtHash(alg)
+	switch alg[:2] {
+	case "HS":
+		secret, ok := key.([]byte)
+		if !ok {
+			return false
+		}
+		mac := hmac.New(hashFunc, secret)
+		mac.Write(input)
+		return hmac.Equal(mac.Sum(nil), sig)
+	case "RS", "PS":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return false
+		}
+		h := hashFunc()
+		h.Write(input)
+		if alg[:2] == "PS" {
+			return rsa.VerifyPSS(pub, hashID, h.Sum(nil), sig, nil) == nil
+		}
+		return rsa.VerifyPKCS1v15(pub, hashID, h.Sum(nil), sig) == nil
+	case "ES":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(sig)%2 != 0 {
+			return false
+		}
+		h := hashFunc()
+		h.Write(input)
+		// JWT uses raw concatenation of r and s values
+		r := new(big.Int).SetBytes(sig[:len(sig)/2])
+		s := new(big.Int).SetBytes(sig[len(sig)/2:])
+		return ecdsa.Verify(pub, h.Sum(nil), r, s)
+	}
+	return false
+}
+
+// helper function to check if JWT audience claim contains given audience
+func jwtAudience(aud interface{}, audience string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == audience
+	case []interface{}:
+		for _, a := range v {
+			if s, ok := a.(string); ok && s == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// helper function to verify JWT token against configured keys and return
+// its claims, tokens should provide expiration time
+func verifyJWT(token string) (map[string]interface{}, error) {
+	if len(_jwtKeys) == 0 {
+		return nil, errors.New("bearer tokens are not configured")
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	data, err := b64decode(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, err
+	}
+	sig, err := b64decode(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	input := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, key := range _jwtKeys {
+		if header.Kid != "" && key.Kid != "" && header.Kid != key.Kid {
+			continue
+		}
+		if verifySignatureJWT(header.Alg, key.Key, input, sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, fmt.Errorf("unable to verify token signature, alg=%s kid=%s", header.Alg, header.Kid)
+	}
+	data, err = b64decode(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	claims := make(map[string]interface{})
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, errors.New("token does not provide expiration time")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return nil, errors.New("token is expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("token is not valid yet")
+	}
+	if _config.JWTIssuer != "" && claims["iss"] != _config.JWTIssuer {
+		return nil, fmt.Errorf("token is not issued by %s", _config.JWTIssuer)
+	}
+	if _config.JWTAudience != "" && !jwtAudience(claims["aud"], _config.JWTAudience) {
+		return nil, fmt.Errorf("token is not issued for %s", _config.JWTAudience)
+	}
+	return claims, nil
+}
+
+// helper function to initialize API keys and JWT tokens from server configuration
+func initTokens() error {
+	_apiKeys = APIKeys{File: _config.APIKeys, Keys: make(map[string]APIKey)}
+	if _config.APIKeys != "" {
+		if err := os.MkdirAll(filepath.Dir(_config.APIKeys), 0700); err != nil {
+			return err
+		}
+		if err := _apiKeys.load(); err != nil {
+			return err
+		}
+	}
+	keys, err := loadJWTKeys(_config.JWKS, _config.JWTSecret)
+	if err != nil {
+		return err
+	}
+	_jwtKeys = keys
+	return nil
+}
+
+// AdminKeysHandler lists API keys or issues new API key
+func AdminKeysHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		responseJSON(w, _apiKeys.list())
+		return
+	}
+	defer r.Body.Close()
+	var req APIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		responseError(w, "unable to decode API key request", err, http.StatusBadRequest)
+		return
+	}
+	key, token, err := _apiKeys.issue(req, requestIdentity(r).Name)
+	if err != nil {
+		responseError(w, fmt.Sprintf("unable to issue API key: %v", err), err, http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(struct {
+		APIKey
+		Key string `json:"key"`
+	}{key, token})
+}
+
+// AdminKeyHandler revokes API key
+func AdminKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if err := _apiKeys.revoke(id); err != nil {
+		responseError(w, fmt.Sprintf("unable to revoke API key %s", id), err, http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
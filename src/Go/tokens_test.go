@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// helper function to make JWT token with given header and claims signed by
+// HMAC-SHA256 with given secret, nil secret leaves token unsigned
+func testJWT(t *testing.T, header, claims map[string]interface{}, secret []byte) string {
+	enc := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	input := enc(header) + "." + enc(claims)
+	if secret == nil {
+		return input + "."
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(input))
+	return input + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// TestVerifyJWT tests verification of JWT tokens
+func TestVerifyJWT(t *testing.T) {
+	secret := []byte("secret")
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := float64(time.Now().Add(time.Hour).Unix())
+	hs256 := map[string]interface{}{"alg": "HS256", "typ": "JWT"}
+	tests := []struct {
+		name  string
+		keys  []JWTKey
+		token string
+		valid bool
+	}{
+		{"HS256", []JWTKey{{Key: secret}},
+			testJWT(t, hs256, map[string]interface{}{"sub": "user", "exp": exp}, secret), true},
+		{"alg none", []JWTKey{{Key: secret}},
+			testJWT(t, map[string]interface{}{"alg": "none"}, map[string]interface{}{"sub": "user", "exp": exp}, nil), false},
+		{"alg none with signature", []JWTKey{{Key: secret}},
+			testJWT(t, map[string]interface{}{"alg": "none"}, map[string]interface{}{"sub": "user", "exp": exp}, secret), false},
+		{"wrong secret", []JWTKey{{Key: secret}},
+			testJWT(t, hs256, map[string]interface{}{"sub": "user", "exp": exp}, []byte("other")), false},
+		// public key should not be used as HMAC secret
+		{"HS256 with public key", []JWTKey{{Key: pub}},
+			testJWT(t, hs256, map[string]interface{}{"sub": "user", "exp": exp}, []byte(pub)), false},
+		{"missing exp", []JWTKey{{Key: secret}},
+			testJWT(t, hs256, map[string]interface{}{"sub": "user"}, secret), false},
+		{"expired", []JWTKey{{Key: secret}},
+			testJWT(t, hs256, map[string]interface{}{"sub": "user", "exp": exp - 7200}, secret), false},
+		{"kid mismatch", []JWTKey{{Kid: "a", Key: secret}},
+			testJWT(t, map[string]interface{}{"alg": "HS256", "kid": "b"}, map[string]interface{}{"sub": "user", "exp": exp}, secret), false},
+		{"malformed", []JWTKey{{Key: secret}}, "abc.def", false},
+		{"no keys", nil,
+			testJWT(t, hs256, map[string]interface{}{"sub": "user", "exp": exp}, secret), false},
+	}
+	defer func(keys []JWTKey) { _jwtKeys = keys }(_jwtKeys)
+	for _, tt := range tests {
+		_jwtKeys = tt.keys
+		claims, err := verifyJWT(tt.token)
+		if tt.valid && err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("%s: token is accepted, claims %v", tt.name, claims)
+		}
+	}
+}
+
+// TestParseJWK tests parsing of JSON web keys
+func TestParseJWK(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64 := base64.RawURLEncoding.EncodeToString
+	tests := []struct {
+		name string
+		jwk  JWK
+		kind string
+	}{
+		{"oct", JWK{Kty: "oct", K: b64([]byte("secret"))}, "bytes"},
+		{"RSA", JWK{Kty: "RSA", N: b64([]byte{0xc1, 0x01}), E: "AQAB"}, "rsa"},
+		{"OKP", JWK{Kty: "OKP", Crv: "Ed25519", X: b64(pub)}, "ed25519"},
+		{"OKP short key", JWK{Kty: "OKP", Crv: "Ed25519", X: b64(pub[:16])}, ""},
+		{"OKP curve", JWK{Kty: "OKP", Crv: "X25519", X: b64(pub)}, ""},
+		{"EC curve", JWK{Kty: "EC", Crv: "P-224"}, ""},
+		{"unknown type", JWK{Kty: "none"}, ""},
+	}
+	for _, tt := range tests {
+		key, err := parseJWK(tt.jwk)
+		if tt.kind == "" {
+			if err == nil {
+				t.Errorf("%s: key is accepted", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+			continue
+		}
+		var ok bool
+		switch tt.kind {
+		case "bytes":
+			_, ok = key.([]byte)
+		case "rsa":
+			_, ok = key.(*rsa.PublicKey)
+		case "ed25519":
+			_, ok = key.(ed25519.PublicKey)
+		}
+		if !ok {
+			t.Errorf("%s: unexpected key type %T", tt.name, key)
+		}
+	}
+}
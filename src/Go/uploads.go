@@ -0,0 +1,452 @@
+package main
+
+// uploads module provides resumable chunked uploads of large model bundles
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// UploadArea defines name of upload sessions area within model directory,
+// it is hidden such that it is not listed as a model
+const UploadArea = ".uploads"
+
+// ChunkChecksumHeader defines HTTP header which carries SHA-256 of uploaded chunk
+const ChunkChecksumHeader = "X-Checksum-Sha256"
+
+// lock to serialize storing of received chunks
+var _chunkLock sync.Mutex
+
+// UploadSession represents resumable upload session of a bundle, its chunks
+// are stored in ModelDir/.uploads/<id> area
+type UploadSession struct {
+	ID       string `json:"id"`       // session identifier
+	Size     int64  `json:"size"`     // expected bundle size, optional
+	Checksum string `json:"checksum"` // expected SHA-256 of the bundle, optional
+	Created  int64  `json:"created"`  // session creation time
+	Owner    string `json:"owner"`    // name of the client who created the session
+	Method   string `json:"method"`   // authentication method of the client who created the session
+}
+
+// UploadChunk represents received chunk of upload session
+type UploadChunk struct {
+	Index    int    `json:"index"`    // chunk number
+	Size     int64  `json:"size"`     // chunk size
+	Checksum string `json:"checksum"` // chunk SHA-256
+}
+
+// UploadStatus represents state of upload session
+type UploadStatus struct {
+	UploadSession
+	Chunks   []UploadChunk `json:"chunks"`   // received chunks
+	Received int64         `json:"received"` // total number of received bytes
+	Offset   int64         `json:"offset"`   // number of contiguous bytes received from the start
+	Next     int           `json:"next"`     // first missing chunk number
+	Updated  int64         `json:"updated"`  // last activity time
+}
+
+// helper function to get area of upload session
+func uploadDir(id string) string {
+	return filepath.Join(_config.ModelDir, UploadArea, id)
+}
+
+// helper function to create new upload session of given client
+func newUploadSession(size int64, checksum string, client Identity) (UploadSession, error) {
+	session := UploadSession{
+		ID:       randomID(),
+		Size:     size,
+		Checksum: strings.ToLower(checksum),
+		Created:  time.Now().Unix(),
+		Owner:    client.Name,
+		Method:   client.Method,
+	}
+	if size > maxBundleSize() {
+		return session, ErrBundleTooLarge
+	}
+	dir := uploadDir(session.ID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return session, err
+	}
+	data, err := json.Marshal(session)
+	if err != nil {
+		return session, err
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "session.json"), data, 0600)
+	return session, err
+}
+
+// helper function to read upload session
+func getUploadSession(id string) (UploadSession, error) {
+	var session UploadSession
+	data, err := ioutil.ReadFile(filepath.Join(uploadDir(id), "session.json"))
+	if err != nil {
+		return session, err
+	}
+	err = json.Unmarshal(data, &session)
+	return session, err
+}
+
+// helper function to get name of chunk file
+func chunkFile(dir string, index int) string {
+	return filepath.Join(dir, fmt.Sprintf("%08d.chunk", index))
+}
+
+// Status returns state of upload session based on its received chunks
+func (s *UploadSession) Status() (UploadStatus, error) {
+	status := UploadStatus{UploadSession: *s}
+	dir := uploadDir(s.ID)
+	info, err := os.Stat(dir)
+	if err != nil {
+		return status, err
+	}
+	status.Updated = info.ModTime().Unix()
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return status, err
+	}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".chunk") {
+			continue
+		}
+		index, err := strconv.Atoi(strings.TrimSuffix(f.Name(), ".chunk"))
+		if err != nil {
+			continue
+		}
+		checksum, err := ioutil.ReadFile(filepath.Join(dir, fmt.Sprintf("%08d.sha256", index)))
+		if err != nil {
+			return status, err
+		}
+		chunk := UploadChunk{Index: index, Size: f.Size(), Checksum: string(checksum)}
+		status.Chunks = append(status.Chunks, chunk)
+		status.Received += f.Size()
+	}
+	sort.Slice(status.Chunks, func(i, j int) bool { return status.Chunks[i].Index < status.Chunks[j].Index })
+	for _, c := range status.Chunks {
+		if c.Index != status.Next {
+			break
+		}
+		status.Offset += c.Size
+		status.Next++
+	}
+	return status, nil
+}
+
+// WriteChunk streams chunk with given number into upload session area, the
+// chunk is kept only if its SHA-256 matches provided checksum
+func (s *UploadSession) WriteChunk(index int, checksum string, r io.Reader) error {
+	checksum = strings.ToLower(checksum)
+	if len(checksum) != sha256.Size*2 {
+		return fmt.Errorf("chunk requires valid %s header", ChunkChecksumHeader)
+	}
+	status, err := s.Status()
+	if err != nil {
+		return err
+	}
+	remaining := maxBundleSize() - status.Received
+	for _, c := range status.Chunks {
+		if c.Index == index {
+			// chunk is re-sent, e.g. after client reconnect
+			remaining += c.Size
+		}
+	}
+	dir := uploadDir(s.ID)
+	tmp, err := ioutil.TempFile(dir, ".chunk-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, hash), &limitedReader{R: r, N: remaining})
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if digest := hex.EncodeToString(hash.Sum(nil)); digest != checksum {
+		return fmt.Errorf("chunk %d checksum mismatch, expected %s got %s", index, checksum, digest)
+	}
+	// chunks may be received in parallel, therefore we check size limit
+	// again with respect to chunks stored in the meantime
+	_chunkLock.Lock()
+	defer _chunkLock.Unlock()
+	status, err = s.Status()
+	if err != nil {
+		return err
+	}
+	received := status.Received + n
+	for _, c := range status.Chunks {
+		if c.Index == index {
+			received -= c.Size
+		}
+	}
+	if received > maxBundleSize() {
+		return ErrBundleTooLarge
+	}
+	sumFile := filepath.Join(dir, fmt.Sprintf("%08d.sha256", index))
+	if err := ioutil.WriteFile(sumFile, []byte(checksum), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), chunkFile(dir, index)); err != nil {
+		return err
+	}
+	if VERBOSE > 0 {
+		log.Printf("upload %s chunk %d size %d", s.ID, index, n)
+	}
+	// mark session activity
+	now := time.Now()
+	return os.Chtimes(dir, now, now)
+}
+
+// Reader returns reader of complete bundle assembled from received chunks
+func (s *UploadSession) Reader() (*chunkReader, error) {
+	status, err := s.Status()
+	if err != nil {
+		return nil, err
+	}
+	if len(status.Chunks) == 0 {
+		return nil, errors.New("upload session does not have any chunk")
+	}
+	if status.Next != len(status.Chunks) {
+		return nil, fmt.Errorf("upload session misses chunk %d", status.Next)
+	}
+	if s.Size > 0 && s.Size != status.Offset {
+		return nil, fmt.Errorf("upload session received %d bytes out of %d", status.Offset, s.Size)
+	}
+	reader := &chunkReader{hash: sha256.New()}
+	for _, c := range status.Chunks {
+		reader.files = append(reader.files, chunkFile(uploadDir(s.ID), c.Index))
+	}
+	return reader, nil
+}
+
+// Remove removes upload session along with its chunks
+func (s *UploadSession) Remove() {
+	if err := os.RemoveAll(uploadDir(s.ID)); err != nil {
+		log.Println("unable to remove upload session", s.ID, err)
+	}
+}
+
+// chunkReader reads chunk files one after another and computes SHA-256 of
+// the read data, files are opened lazily to not exhaust file descriptors
+type chunkReader struct {
+	files []string
+	file  *os.File
+	hash  hash.Hash
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if c.file == nil {
+			if len(c.files) == 0 {
+				return 0, io.EOF
+			}
+			file, err := os.Open(c.files[0])
+			if err != nil {
+				return 0, err
+			}
+			c.file = file
+			c.files = c.files[1:]
+		}
+		n, err := c.file.Read(p)
+		c.hash.Write(p[:n])
+		if err == io.EOF {
+			c.file.Close()
+			c.file = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+// Checksum reads remaining data and returns SHA-256 of all chunks
+func (c *chunkReader) Checksum() (string, error) {
+	if _, err := io.Copy(ioutil.Discard, c); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(c.hash.Sum(nil)), nil
+}
+
+// Close closes currently opened chunk file
+func (c *chunkReader) Close() error {
+	if c.file != nil {
+		return c.file.Close()
+	}
+	return nil
+}
+
+// helper function to remove upload sessions without activity longer than ttl
+func cleanupUploads(ttl time.Duration) {
+	for {
+		time.Sleep(time.Minute)
+		dir := filepath.Join(_config.ModelDir, UploadArea)
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Println("unable to read upload area", err)
+			}
+			continue
+		}
+		for _, f := range files {
+			if f.IsDir() && time.Since(f.ModTime()) > ttl {
+				log.Println("remove abandoned upload session", f.Name())
+				if err := os.RemoveAll(filepath.Join(dir, f.Name())); err != nil {
+					log.Println("unable to remove upload session", f.Name(), err)
+				}
+			}
+		}
+	}
+}
+
+// UploadSessionHandler creates new upload session, e.g.
+// curl -X POST -d '{"size": 123, "checksum": "<sha256>"}' /uploads
+func UploadSessionHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	var session UploadSession
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&session); err != nil && err != io.EOF {
+			responseError(w, "unable to decode upload session", err, http.StatusBadRequest)
+			return
+		}
+	}
+	session, err := newUploadSession(session.Size, session.Checksum, requestIdentity(r))
+	if err != nil {
+		bundleError(w, "unable to create upload session", err)
+		return
+	}
+	log.Println("create upload session", session.ID)
+	status, err := session.Status()
+	if err != nil {
+		responseError(w, "unable to get upload session status", err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location", basePath(fmt.Sprintf("/uploads/%s", session.ID)))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(status)
+}
+
+// helper function to get upload session of the request, sessions are
+// available only to clients who created them and to admins
+func requestSession(w http.ResponseWriter, r *http.Request) (UploadSession, bool) {
+	id := mux.Vars(r)["id"]
+	session, err := getUploadSession(id)
+	client := requestIdentity(r)
+	if err == nil && !client.HasRole(RoleAdmin) && (session.Owner != client.Name || session.Method != client.Method) {
+		err = fmt.Errorf("upload session %s belongs to other client", id)
+	}
+	if err != nil {
+		msg := fmt.Sprintf("unknown upload session %s", id)
+		responseError(w, msg, err, http.StatusNotFound)
+		return session, false
+	}
+	return session, true
+}
+
+// UploadStatusHandler returns state of upload session, e.g. received chunks
+// and offsets, or removes upload session
+func UploadStatusHandler(w http.ResponseWriter, r *http.Request) {
+	session, ok := requestSession(w, r)
+	if !ok {
+		return
+	}
+	if r.Method == "DELETE" {
+		log.Println("abort upload session", session.ID)
+		session.Remove()
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	status, err := session.Status()
+	if err != nil {
+		responseError(w, "unable to get upload session status", err, http.StatusInternalServerError)
+		return
+	}
+	responseJSON(w, status)
+}
+
+// UploadChunkHandler stores numbered chunk of upload session, e.g.
+// curl -X PUT -H "X-Checksum-Sha256: <sha256>" --data-binary @chunk.0 /uploads/<id>/0
+func UploadChunkHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	session, ok := requestSession(w, r)
+	if !ok {
+		return
+	}
+	index, err := strconv.Atoi(mux.Vars(r)["chunk"])
+	if err != nil {
+		responseError(w, "invalid chunk number", err, http.StatusBadRequest)
+		return
+	}
+	err = session.WriteChunk(index, r.Header.Get(ChunkChecksumHeader), r.Body)
+	if err != nil {
+		bundleError(w, fmt.Sprintf("unable to store chunk %d", index), err)
+		return
+	}
+	status, err := session.Status()
+	if err != nil {
+		responseError(w, "unable to get upload session status", err, http.StatusInternalServerError)
+		return
+	}
+	responseJSON(w, status)
+}
+
+// UploadFinalizeHandler assembles bundle from received chunks, validates and
+// activates it, dryrun=true query parameter only validates the bundle
+func UploadFinalizeHandler(w http.ResponseWriter, r *http.Request) {
+	session, ok := requestSession(w, r)
+	if !ok {
+		return
+	}
+	reader, err := session.Reader()
+	if err != nil {
+		responseError(w, "unable to finalize upload", err, http.StatusConflict)
+		return
+	}
+	defer reader.Close()
+	bundle, err := newBundle()
+	if err != nil {
+		responseError(w, "unable to create staging area", err, http.StatusInternalServerError)
+		return
+	}
+	defer bundle.Cleanup()
+	if err := bundle.Unpack(reader); err != nil {
+		bundleError(w, "unable to unpack bundle", err)
+		return
+	}
+	checksum, err := reader.Checksum()
+	if err != nil {
+		responseError(w, "unable to read upload chunks", err, http.StatusInternalServerError)
+		return
+	}
+	if session.Checksum != "" && session.Checksum != checksum {
+		msg := fmt.Sprintf("bundle checksum mismatch, expected %s got %s", session.Checksum, checksum)
+		responseError(w, msg, nil, http.StatusBadRequest)
+		return
+	}
+	log.Println("finalize upload session", session.ID, "bundle", checksum)
+	deployBundle(w, r, bundle)
+	if !dryRun(r) {
+		// failed bundles can't be fixed by re-sending chunks
+		session.Remove()
+	}
+}
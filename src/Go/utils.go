@@ -1,31 +1,20 @@
 package main
 
 import (
-	"archive/tar"
 	"crypto/tls"
-	"encoding/json"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"os/user"
 	"path/filepath"
-	"time"
+	"strings"
 
+	"github.com/shirou/gopsutil/process"
 	"github.com/vkuznet/x509proxy"
 )
 
-// UserDNs structure holds information about user DNs
-type UserDNs struct {
-	DNs  []string
-	Time time.Time
-}
-
-// global variable which we initialize once
-var _userDNs UserDNs
-
 // global HTTP client
 var _client *http.Client
 
@@ -87,52 +76,6 @@ func httpClient() *http.Client {
 	return &http.Client{Transport: tr}
 }
 
-func userDNs() []string {
-	var out []string
-	rurl := "https://cmsweb.cern.ch/sitedb/data/prod/people"
-	req, err1 := http.NewRequest("GET", rurl, nil)
-	if err1 != nil {
-		log.Println("Unable to make GET request", err1)
-		return out
-	}
-	req.Header.Add("Accept", "*/*")
-	resp, err2 := _client.Do(req)
-	if err2 != nil {
-		log.Println("Unable to place HTTP request", err2)
-		return out
-	}
-	defer resp.Body.Close()
-	data, err3 := ioutil.ReadAll(resp.Body)
-	if err3 != nil {
-		log.Println("Unable to make GET request", err3)
-		return out
-	}
-	var rec map[string]interface{}
-	err4 := json.Unmarshal(data, &rec)
-	if err4 != nil {
-		log.Println("Unable to unmarshal response", err4)
-		return out
-	}
-	desc := rec["desc"].(map[string]interface{})
-	headers := desc["columns"].([]interface{})
-	var idx int
-	for i, h := range headers {
-		if h.(string) == "dn" {
-			idx = i
-			break
-		}
-	}
-	values := rec["result"].([]interface{})
-	for _, item := range values {
-		val := item.([]interface{})
-		v := val[idx]
-		if v != nil {
-			out = append(out, v.(string))
-		}
-	}
-	return out
-}
-
 // InList helper function to check item in a list
 func InList(a string, list []string) bool {
 	check := 0
@@ -147,31 +90,6 @@ func InList(a string, list []string) bool {
 	return false
 }
 
-// UserDN function parses user Distinguished Name (DN) from client's HTTP request
-func UserDN(r *http.Request) string {
-	var names []interface{}
-	for _, cert := range r.TLS.PeerCertificates {
-		for _, name := range cert.Subject.Names {
-			switch v := name.Value.(type) {
-			case string:
-				names = append(names, v)
-			}
-		}
-	}
-	parts := names[:7]
-	return fmt.Sprintf("/DC=%s/DC=%s/OU=%s/OU=%s/CN=%s/CN=%s/CN=%s", parts...)
-}
-
-// custom logic for CMS authentication, users may implement their own logic here
-func auth(r *http.Request) bool {
-	userDN := UserDN(r)
-	match := InList(userDN, _userDNs.DNs)
-	if !match {
-		log.Println("userDN not found in SiteDB", userDN)
-	}
-	return match
-}
-
 // TFModels provides list of existing models
 func TFModels() ([]TFParams, error) {
 	var models []TFParams
@@ -182,62 +100,56 @@ func TFModels() ([]TFParams, error) {
 	}
 	// loop over found model areas and read their parameters
 	for _, f := range files {
-		path := fmt.Sprintf("%s/%s", _config.ModelDir, f.Name())
-		fname := fmt.Sprintf("%s/params.json", path)
-		file, err := os.Open(fname)
-		defer file.Close()
-		if err == nil {
-			var params TFParams
-			if err := json.NewDecoder(file).Decode(&params); err != nil {
-				return models, err
-			}
-			if params.TimeStamp == "" {
-				params.TimeStamp = time.Now().String()
-			}
-			models = append(models, params)
-		} else {
+		if !isModelArea(f) {
+			continue
+		}
+		params, err := readParams(f.Name())
+		if err != nil {
 			return models, err
 		}
+		params.Checksums = modelChecksums(f.Name())
+		models = append(models, params)
 	}
 	return models, nil
 }
 
-// Untar helper function to untar given tarball into target destination
-// based on https://golangdocs.com/tar-gzip-in-golang
-func Untar(tarball, target string) error {
-	reader, err := os.Open(tarball)
-	if err != nil {
-		return err
+// helper function to check if given entry of model directory is a model area,
+// model areas can be symlinks while hidden areas are used for staging
+func isModelArea(f os.FileInfo) bool {
+	if strings.HasPrefix(f.Name(), ".") {
+		return false
 	}
-	defer reader.Close()
-	tarReader := tar.NewReader(reader)
-
-	for {
-		header, err := tarReader.Next()
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return err
-		}
-
-		path := filepath.Join(target, header.Name)
-		info := header.FileInfo()
-		if info.IsDir() {
-			if err = os.MkdirAll(path, info.Mode()); err != nil {
-				return err
-			}
-			continue
-		}
+	if f.Mode()&os.ModeSymlink != 0 {
+		info, err := os.Stat(filepath.Join(_config.ModelDir, f.Name()))
+		return err == nil && info.IsDir()
+	}
+	return f.IsDir()
+}
 
-		file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode())
+// helper function to get total size of files in given directory
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
-		defer file.Close()
-		_, err = io.Copy(file, tarReader)
-		if err != nil {
-			return err
+		if !info.IsDir() {
+			size += info.Size()
 		}
+		return nil
+	})
+	return size, err
+}
+
+// helper function to get RSS memory of our process
+func processRSS() int64 {
+	proc, err := process.NewProcess(int32(os.Getpid()))
+	if err != nil {
+		return 0
+	}
+	minfo, err := proc.MemoryInfo()
+	if err != nil {
+		return 0
 	}
-	return nil
+	return int64(minfo.RSS)
 }
@@ -0,0 +1,288 @@
+package main
+
+// validate module provides validation reports of uploaded models
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	tf "github.com/galeone/tensorflow/tensorflow/go"
+)
+
+// ModelReport represents validation report of single model
+type ModelReport struct {
+	Name     string   `json:"name"`     // model name
+	Flavor   string   `json:"flavor"`   // model flavor
+	Errors   []string `json:"errors"`   // validation errors
+	Warnings []string `json:"warnings"` // validation warnings
+
+	Evaluation *Evaluation    `json:"evaluation,omitempty"` // evaluation of test dataset
+	Inferred   *ModelMetadata `json:"inferred,omitempty"`   // input and output nodes inferred from the graph
+}
+
+// helper function to add error to model report
+func (m *ModelReport) errorf(format string, args ...interface{}) {
+	m.Errors = append(m.Errors, fmt.Sprintf(format, args...))
+}
+
+// helper function to add warning to model report
+func (m *ModelReport) warnf(format string, args ...interface{}) {
+	m.Warnings = append(m.Warnings, fmt.Sprintf(format, args...))
+}
+
+// helper function to add input and output nodes inferred from the model
+// graph to model report
+func (m *ModelReport) infer(inferred ModelMetadata) {
+	if inferred == (ModelMetadata{}) {
+		return
+	}
+	m.Inferred = &inferred
+	for _, v := range [][2]string{
+		{"input_node", inferred.InputNode}, {"output_node", inferred.OutputNode},
+		{"input_name", inferred.InputName}, {"output_name", inferred.OutputName},
+	} {
+		if v[1] != "" {
+			m.warnf("model params do not provide %s, inferred %s from the graph", v[0], v[1])
+		}
+	}
+}
+
+// ValidationReport represents validation report of uploaded bundle
+type ValidationReport struct {
+	Valid  bool          `json:"valid"`           // bundle is valid
+	Error  string        `json:"error,omitempty"` // first validation error
+	Errors []string      `json:"errors"`          // bundle level errors
+	Models []ModelReport `json:"models"`          // per-model reports
+}
+
+// Err returns first validation error of the report
+func (r *ValidationReport) Err() error {
+	if len(r.Errors) > 0 {
+		return errors.New(r.Errors[0])
+	}
+	for _, m := range r.Models {
+		if len(m.Errors) > 0 {
+			return fmt.Errorf("model %s: %s", m.Name, m.Errors[0])
+		}
+	}
+	return nil
+}
+
+// Report validates all bundle models and returns validation report
+func (b *Bundle) Report() ValidationReport {
+	var report ValidationReport
+	if len(b.Models) == 0 {
+		report.Errors = append(report.Errors, "bundle does not contain any model")
+	}
+	for _, name := range b.Models {
+		path := filepath.Join(b.Root, name)
+		mreport := validateModelArea(path, name)
+		if mreport.Inferred != nil {
+			// inferred nodes are applied to model params when the model is read
+			if err := writeMetadata(path, *mreport.Inferred); err != nil {
+				mreport.errorf("unable to store inferred nodes: %v", err)
+			}
+		}
+		if mreport.Evaluation != nil {
+			// evaluation report is activated along with the model
+			if err := writeEvaluation(path, mreport.Evaluation); err != nil {
+				mreport.errorf("unable to store evaluation report: %v", err)
+			}
+		}
+		report.Models = append(report.Models, mreport)
+	}
+	if err := report.Err(); err != nil {
+		report.Error = err.Error()
+	} else {
+		report.Valid = true
+	}
+	return report
+}
+
+// Validate checks that all bundle models are valid and loadable
+func (b *Bundle) Validate() error {
+	report := b.Report()
+	return report.Err()
+}
+
+// helper function to validate model in given model area
+func validateModelArea(path, name string) ModelReport {
+	report := ModelReport{Name: name}
+	params, flavor, err := checkModelArea(path, name)
+	report.Flavor = flavor
+	if err != nil {
+		report.errorf("%v", err)
+		return report
+	}
+	if !sealModelArea(path, &report) {
+		return report
+	}
+	switch flavor {
+	case "tf1":
+		validateGraphModel(path, params, &report)
+	case "tf2":
+		validateSavedModel(path, params, &report)
+	}
+	return report
+}
+
+// helper function to validate TF 1.X model
+func validateGraphModel(path string, params TFParams, report *ModelReport) {
+	graph, labels, err := loadModel(filepath.Join(path, params.Model), filepath.Join(path, params.Labels))
+	if err != nil {
+		report.errorf("unable to load model: %v", err)
+		return
+	}
+	input, output, inferred, err := resolveNodes(graph, nil, params, "tf1")
+	if err != nil {
+		report.errorf("%v", err)
+		return
+	}
+	report.infer(inferred)
+	checkLabels(graph, output, labels, report)
+	if params.ImgChannels > 0 {
+		// image models require image inputs
+		if params.Test != nil {
+			report.warnf("test dataset is not supported for image models")
+		}
+		return
+	}
+	session, err := tf.NewSession(graph, _sessionOptions)
+	if err != nil {
+		report.errorf("unable to create session: %v", err)
+		return
+	}
+	defer session.Close()
+	runner := &modelRunner{Graph: graph, Session: session, Input: input, Output: output}
+	runSamples(path, params, runner, report)
+}
+
+// helper function to validate TF 2.X SavedModel
+func validateSavedModel(path string, params TFParams, report *ModelReport) {
+	model, err := tf.LoadSavedModel(path, []string{"serve"}, _sessionOptions)
+	if err != nil {
+		report.errorf("unable to load SavedModel: %v", err)
+		return
+	}
+	defer model.Session.Close()
+	var keys []string
+	for key, sig := range model.Signatures {
+		var inputs, outputs []string
+		for k, v := range sig.Inputs {
+			inputs = append(inputs, fmt.Sprintf("%s:%s", k, v.Name))
+		}
+		for k, v := range sig.Outputs {
+			outputs = append(outputs, fmt.Sprintf("%s:%s", k, v.Name))
+		}
+		sort.Strings(inputs)
+		sort.Strings(outputs)
+		keys = append(keys, fmt.Sprintf("%s inputs=[%s] outputs=[%s]", key, strings.Join(inputs, ","), strings.Join(outputs, ",")))
+	}
+	sort.Strings(keys)
+	if len(keys) == 0 {
+		report.warnf("SavedModel does not provide any signature")
+	} else if VERBOSE > 0 {
+		report.warnf("SavedModel signatures: %s", strings.Join(keys, "; "))
+	}
+	input, output, inferred, err := resolveNodes(model.Graph, model.Signatures, params, "tf2")
+	if err != nil {
+		report.errorf("%v", err)
+		return
+	}
+	if params.InputName == "" && input == DefaultInputName {
+		report.warnf("model params do not provide input_name, use %s", input)
+	}
+	if params.OutputName == "" && output == DefaultOutputName {
+		report.warnf("model params do not provide output_name, use %s", output)
+	}
+	report.infer(inferred)
+	if params.Labels != "" {
+		labels, err := readLabels(filepath.Join(path, params.Labels))
+		if err != nil {
+			report.errorf("unable to read labels: %v", err)
+		} else {
+			checkLabels(model.Graph, output, labels, report)
+		}
+	}
+	if params.ImgChannels > 0 {
+		if params.Test != nil {
+			report.warnf("test dataset is not supported for image models")
+		}
+		return
+	}
+	runner := &modelRunner{Graph: model.Graph, Session: model.Session, Input: input, Output: output}
+	runSamples(path, params, runner, report)
+}
+
+// helper function to check number of labels with respect to model output width
+func checkLabels(graph *tf.Graph, output string, labels []string, report *ModelReport) {
+	shape := graph.Operation(output).Output(0).Shape()
+	ndim := shape.NumDimensions()
+	if ndim <= 0 || len(labels) == 0 {
+		return
+	}
+	width := shape.Size(ndim - 1)
+	if width > 0 && int64(len(labels)) != width {
+		report.warnf("number of labels %d does not match model output width %d", len(labels), width)
+	}
+}
+
+// modelRunner runs inference of model loaded from its model area
+type modelRunner struct {
+	Graph   *tf.Graph
+	Session *tf.Session
+	Input   string
+	Output  string
+}
+
+// helper function to run inference for given values
+func (m *modelRunner) predict(values []float32) ([]float32, error) {
+	tensor, err := tf.NewTensor([][]float32{values})
+	if err != nil {
+		return nil, err
+	}
+	results, err := m.Session.Run(
+		map[tf.Output]*tf.Tensor{m.Graph.Operation(m.Input).Output(0): tensor},
+		[]tf.Output{m.Graph.Operation(m.Output).Output(0)},
+		nil)
+	if err != nil {
+		return nil, err
+	}
+	probs, ok := results[0].Value().([][]float32)
+	if !ok || len(probs) == 0 {
+		return nil, fmt.Errorf("unsupported model output %v", results[0].DataType())
+	}
+	return probs[0], nil
+}
+
+// helper function to run model samples and test dataset through the model
+func runSamples(path string, params TFParams, runner *modelRunner, report *ModelReport) {
+	rows, err := warmupSamples(path, params)
+	if err != nil {
+		report.errorf("unable to read sample inputs: %v", err)
+		return
+	}
+	for i, row := range rows {
+		if _, err := runner.predict(row.Values); err != nil {
+			report.errorf("sample %d: %v", i, err)
+		}
+	}
+	if params.Test != nil {
+		evaluateModel(path, params, runner, report)
+	}
+}
+
+// helper function to check if request asks for validation only
+func dryRun(r *http.Request) bool {
+	for _, key := range []string{"dryrun", "validate"} {
+		v := strings.ToLower(r.URL.Query().Get(key))
+		if v == "1" || v == "true" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,212 @@
+package main
+
+// watcher module provides hot reloading of models in model directory
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// ModelWatcher watches model directory and (re)loads changed models
+type ModelWatcher struct {
+	Watcher *fsnotify.Watcher
+	Delay   time.Duration // quiet period before we handle model changes
+	timers  map[string]*time.Timer
+	mu      sync.Mutex
+}
+
+// helper function to start model directory watcher
+func watchModels(delay time.Duration) (*ModelWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	mw := &ModelWatcher{Watcher: watcher, Delay: delay, timers: make(map[string]*time.Timer)}
+	if err := mw.addDir(_config.ModelDir); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	go mw.run()
+	log.Printf("watch %s for model changes, delay %v", _config.ModelDir, delay)
+	return mw, nil
+}
+
+// helper function to recursively add given directory to the watcher,
+// fsnotify does not watch sub-directories on its own
+func (mw *ModelWatcher) addDir(dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			// skip hidden areas, e.g. staging area of uploaded bundles
+			if path != dir && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return mw.Watcher.Add(path)
+		}
+		return nil
+	})
+}
+
+// helper function to get model name for given file system path
+func (mw *ModelWatcher) modelName(path string) string {
+	rel, err := filepath.Rel(_config.ModelDir, path)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return ""
+	}
+	name := strings.Split(rel, string(os.PathSeparator))[0]
+	if strings.HasPrefix(name, ".") {
+		// skip hidden and temporary areas, e.g. used by rsync
+		return ""
+	}
+	return name
+}
+
+// main loop of model watcher
+func (mw *ModelWatcher) run() {
+	for {
+		select {
+		case event, ok := <-mw.Watcher.Events:
+			if !ok {
+				return
+			}
+			if VERBOSE > 1 {
+				log.Println("watcher event", event)
+			}
+			name := mw.modelName(event.Name)
+			if name == "" {
+				continue
+			}
+			if event.Op&fsnotify.Create == fsnotify.Create {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					if err := mw.addDir(event.Name); err != nil {
+						log.Println("unable to watch", event.Name, err)
+					}
+				}
+			}
+			mw.schedule(name)
+		case err, ok := <-mw.Watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Println("watcher error", err)
+		}
+	}
+}
+
+// schedule model update once model area is not changed during watcher delay,
+// e.g. rsync or deployment pipeline may copy model files one by one
+func (mw *ModelWatcher) schedule(name string) {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+	if timer, ok := mw.timers[name]; ok {
+		timer.Reset(mw.Delay)
+		return
+	}
+	mw.timers[name] = time.AfterFunc(mw.Delay, func() {
+		mw.mu.Lock()
+		delete(mw.timers, name)
+		mw.mu.Unlock()
+		updateModel(name)
+	})
+}
+
+// Close stops model watcher
+func (mw *ModelWatcher) Close() error {
+	return mw.Watcher.Close()
+}
+
+// areaStamp identifies content of model area, i.e. its directory and the
+// latest modification time of its files
+type areaStamp struct {
+	Info    os.FileInfo
+	ModTime time.Time
+}
+
+// model areas activated by the server, guarded by _activateLock
+var _activated = make(map[string]areaStamp)
+
+// helper function to get stamp of given model area
+func stampModelArea(path string) (areaStamp, error) {
+	var stamp areaStamp
+	info, err := os.Stat(path)
+	if err != nil {
+		return stamp, err
+	}
+	stamp.Info = info
+	err = filepath.Walk(path, func(fname string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(stamp.ModTime) {
+			stamp.ModTime = info.ModTime()
+		}
+		return nil
+	})
+	return stamp, err
+}
+
+// helper function to remember model area activated by the server such that
+// watcher does not reload it again, caller should hold _activateLock
+func markActivated(name string) {
+	stamp, err := stampModelArea(filepath.Join(_config.ModelDir, name))
+	if err != nil {
+		log.Println("unable to stamp model area", name, err)
+		delete(_activated, name)
+		return
+	}
+	_activated[name] = stamp
+}
+
+// helper function to check if model area is not changed since the server
+// activated it, caller should hold _activateLock
+func activatedArea(name string) bool {
+	prev, ok := _activated[name]
+	if !ok {
+		return false
+	}
+	stamp, err := stampModelArea(filepath.Join(_config.ModelDir, name))
+	if err != nil {
+		return false
+	}
+	return os.SameFile(prev.Info, stamp.Info) && prev.ModTime.Equal(stamp.ModTime)
+}
+
+// helper function to handle new, changed or removed model area
+func updateModel(name string) {
+	// wait for activation of uploaded models, their areas are already loaded
+	_activateLock.Lock()
+	defer _activateLock.Unlock()
+	defer refreshModels()
+	path := filepath.Join(_config.ModelDir, name)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		log.Println("model", name, "is removed")
+		delete(_activated, name)
+		_cache.remove(name)
+		return
+	}
+	if activatedArea(name) {
+		if VERBOSE > 0 {
+			log.Println("model", name, "is activated by the server, skip reload")
+		}
+		return
+	}
+	delete(_activated, name)
+	if err := checkModel(name); err != nil {
+		// we keep serving previous version of the model if any
+		log.Printf("model %s is not valid: %v", name, err)
+		return
+	}
+	if err := activateModel(name); err != nil {
+		log.Printf("unable to reload model %s: %v", name, err)
+		return
+	}
+	log.Println("model", name, "is updated")
+}